@@ -1,121 +1,189 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/glebson1988/httpfromtcp/internal/client"
+	"github.com/glebson1988/httpfromtcp/internal/fileserver"
 	"github.com/glebson1988/httpfromtcp/internal/request"
 	"github.com/glebson1988/httpfromtcp/internal/response"
+	"github.com/glebson1988/httpfromtcp/internal/router"
 	"github.com/glebson1988/httpfromtcp/internal/server"
 )
 
-const port = 42069
+const (
+	port       = 42069
+	videoPath  = "assets/vim.mp4"
+	httpbinURL = "https://httpbin.org"
+
+	shutdownTimeout = 10 * time.Second
+)
 
 func main() {
-	handler := newHandler()
-	srv, err := server.Serve(port, handler)
+	// Cancelled on shutdown, so proxied requests don't hold it up waiting on
+	// upstream.
+	upstreamCtx, cancelUpstream := context.WithCancel(context.Background())
+	handler, err := newHandler(upstreamCtx, httpbinURL, client.New())
+	if err != nil {
+		log.Fatalf("Error registering routes: %v", err)
+	}
+	handler = server.Chain(logRequests)(handler)
+	srv, err := server.ServeConfig(server.Config{
+		Addr:              fmt.Sprintf(":%d", port),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}, handler)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer srv.Close()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+	cancelUpstream()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if interrupted, err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Server stopped, %d connections interrupted: %v", interrupted, err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
 
-func newHandler() func(w *response.Writer, req *request.Request) {
+// newHandler returns the demo handler, routing by method and path. Requests
+// under /httpbin/ are proxied to upstream through proxy, and cancelling ctx
+// aborts the ones in flight.
+func newHandler(ctx context.Context, upstream string, proxy *client.Client) (server.Handler, error) {
+	r := router.New()
+	routes := []struct {
+		method, pattern string
+		handler         server.Handler
+	}{
+		{"GET", "/httpbin/{path...}", proxyHandler(ctx, upstream, proxy)},
+		{"GET", "/video", func(w *response.Writer, req *request.Request) {
+			fileserver.ServeFile(w, req, videoPath, "video/mp4")
+		}},
+		{"GET", "/yourproblem", page(response.StatusBadRequest, yourProblemPage)},
+		{"GET", "/myproblem", page(response.StatusInternalServerError, myProblemPage)},
+		{"GET", "/", page(response.StatusOK, successPage)},
+	}
+	for _, route := range routes {
+		if err := r.Handle(route.method, route.pattern, route.handler); err != nil {
+			return nil, err
+		}
+	}
+	return r.Serve, nil
+}
+
+// logRequests logs every request with its status, body size and duration.
+func logRequests(next server.Handler) server.Handler {
 	return func(w *response.Writer, req *request.Request) {
-		if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-			targetPath := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
-			resp, err := http.Get("https://httpbin.org" + targetPath)
+		start := time.Now()
+		// The hook runs once the server has finished the response, so the
+		// status and size are final, including answers the server sends in
+		// the handler's place.
+		w.OnFinish(func(err error) {
 			if err != nil {
-				body := []byte("failed to reach upstream")
-				headers := response.GetDefaultHeaders(len(body))
-				if err := w.WriteStatusLine(response.StatusInternalServerError); err != nil {
-					return
-				}
-				if err := w.WriteHeaders(headers); err != nil {
-					return
-				}
-				_, _ = w.WriteBody(body)
+				log.Printf("%s %s: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
 				return
 			}
-			defer resp.Body.Close()
-
-			headers := make(response.Headers)
-			for key, values := range resp.Header {
-				headers.Set(key, strings.Join(values, ", "))
-			}
-			delete(headers, "content-length")
-			headers.Set("Transfer-Encoding", "chunked")
-			headers.Set("Trailer", "X-Content-SHA256, X-Content-Length")
+			log.Printf("%s %s %d %dB %v", req.RequestLine.Method, req.RequestLine.RequestTarget, w.Status(), w.BytesWritten(), time.Since(start))
+		})
+		next(w, req)
+	}
+}
 
-			if err := w.WriteStatusLine(response.StatusCode(resp.StatusCode)); err != nil {
+// proxyHandler streams the upstream response for the path under /httpbin/
+// back with chunked encoding and SHA-256/length trailers. Responses whose
+// status allows no body are passed on with their headers alone. The body is
+// hashed as it streams, and cancelling ctx aborts the upstream fetch.
+func proxyHandler(ctx context.Context, upstream string, proxy *client.Client) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		target := req.RequestLine.Target
+		upstreamURL := upstream + strings.TrimPrefix(target.RawPath, "/httpbin")
+		if target.RawQuery != "" {
+			upstreamURL += "?" + target.RawQuery
+		}
+		resp, err := proxy.Get(ctx, upstreamURL)
+		if err != nil {
+			body := []byte("failed to reach upstream")
+			headers := response.GetDefaultHeaders(len(body))
+			if err := w.WriteStatusLine(response.StatusInternalServerError); err != nil {
 				return
 			}
 			if err := w.WriteHeaders(headers); err != nil {
 				return
 			}
+			_, _ = w.WriteBody(body)
+			return
+		}
+		defer resp.BodyReader.Close()
 
-			buf := make([]byte, 1024)
-			var fullBody []byte
-			for {
-				n, err := resp.Body.Read(buf)
-				log.Println(n)
-				if n > 0 {
-					fullBody = append(fullBody, buf[:n]...)
-					if _, err := w.WriteChunkedBody(buf[:n]); err != nil {
-						return
-					}
-				}
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					return
-				}
-			}
-			sum := sha256.Sum256(fullBody)
-			trailers := make(response.Headers)
-			trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", sum))
-			trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-			_ = w.WriteTrailers(trailers)
+		// 204 and 304 responses carry no body, so there is nothing to chunk
+		// or checksum.
+		hasBody := resp.StatusLine.StatusCode.AllowsBody()
+		headers := proxyHeaders(resp.Headers)
+		if hasBody {
+			headers.Set("Transfer-Encoding", "chunked")
+			headers.Set("Trailer", "X-Content-SHA256, X-Content-Length")
+		}
+
+		if err := w.WriteStatusLineWithReason(resp.StatusLine.StatusCode, resp.StatusLine.ReasonPhrase); err != nil {
+			return
+		}
+		if err := w.WriteHeaders(headers); err != nil || !hasBody {
 			return
 		}
 
-		var statusCode response.StatusCode
-		var body string
-		switch req.RequestLine.RequestTarget {
-		case "/video":
-			videoBytes, err := os.ReadFile("assets/vim.mp4")
-			if err != nil {
-				statusCode = response.StatusInternalServerError
-				body = "failed to read video"
-				break
+		buf := make([]byte, 1024)
+		sum := sha256.New()
+		var size int64
+		for {
+			n, err := resp.BodyReader.Read(buf)
+			if n > 0 {
+				sum.Write(buf[:n])
+				size += int64(n)
+				if _, err := w.WriteChunkedBody(buf[:n]); err != nil {
+					return
+				}
 			}
-			headers := response.GetDefaultHeaders(len(videoBytes))
-			headers.Set("Content-Type", "video/mp4")
-			if err := w.WriteStatusLine(response.StatusOK); err != nil {
-				return
+			if err == io.EOF {
+				break
 			}
-			if err := w.WriteHeaders(headers); err != nil {
+			if err != nil {
 				return
 			}
-			_, _ = w.WriteBody(videoBytes)
-			return
-		case "/yourproblem":
-			statusCode = response.StatusBadRequest
-			body = `<html>
+		}
+		trailers := response.Headers{}
+		trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", sum.Sum(nil)))
+		trailers.Set("X-Content-Length", fmt.Sprintf("%d", size))
+		_ = w.WriteTrailers(trailers)
+	}
+}
+
+// page answers with an HTML page carrying a computed ETag.
+func page(statusCode response.StatusCode, body string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.ComputeETag()
+		w.SetStatus(statusCode)
+		_, _ = io.WriteString(w, body)
+	}
+}
+
+const yourProblemPage = `<html>
   <head>
     <title>400 Bad Request</title>
   </head>
@@ -125,9 +193,8 @@ func newHandler() func(w *response.Writer, req *request.Request) {
   </body>
 </html>
 `
-		case "/myproblem":
-			statusCode = response.StatusInternalServerError
-			body = `<html>
+
+const myProblemPage = `<html>
   <head>
     <title>500 Internal Server Error</title>
   </head>
@@ -137,9 +204,8 @@ func newHandler() func(w *response.Writer, req *request.Request) {
   </body>
 </html>
 `
-		default:
-			statusCode = response.StatusOK
-			body = `<html>
+
+const successPage = `<html>
   <head>
     <title>200 OK</title>
   </head>
@@ -149,18 +215,28 @@ func newHandler() func(w *response.Writer, req *request.Request) {
   </body>
 </html>
 `
-		}
 
-		bodyBytes := []byte(body)
-		headers := response.GetDefaultHeaders(len(bodyBytes))
-		headers.Set("Content-Type", "text/html")
+// hopByHopHeaders describe the upstream connection and framing, so they are
+// not passed on to the client.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Trailer",
+	"Upgrade",
+	"Content-Length",
+}
 
-		if err := w.WriteStatusLine(statusCode); err != nil {
-			return
-		}
-		if err := w.WriteHeaders(headers); err != nil {
-			return
-		}
-		_, _ = w.WriteBody(bodyBytes)
+// proxyHeaders copies the upstream fields in their original order, minus the
+// hop-by-hop ones and any that Connection names as such.
+func proxyHeaders(upstream response.Headers) response.Headers {
+	proxied := upstream.Clone()
+	for _, name := range strings.Split(upstream.Get("Connection"), ",") {
+		proxied.Del(strings.TrimSpace(name))
+	}
+	for _, name := range hopByHopHeaders {
+		proxied.Del(name)
 	}
+	return proxied
 }
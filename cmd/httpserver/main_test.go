@@ -1,82 +1,89 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
 	"io"
-	"net/http"
+	"net"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/glebson1988/httpfromtcp/internal/client"
 	"github.com/glebson1988/httpfromtcp/internal/request"
 	"github.com/glebson1988/httpfromtcp/internal/response"
 )
 
-type roundTripFunc func(*http.Request) (*http.Response, error)
-
-func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
-	return f(r)
-}
-
-type chunkedBody struct {
-	chunks [][]byte
-	index  int
-}
-
-func (b *chunkedBody) Read(p []byte) (int, error) {
-	if b.index >= len(b.chunks) {
-		return 0, io.EOF
+// startUpstream serves raw on every connection and reports the request line
+// it was sent.
+func startUpstream(t *testing.T, raw string) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
 	}
-	n := copy(p, b.chunks[b.index])
-	b.index++
-	return n, nil
-}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
 
-func (b *chunkedBody) Close() error {
-	return nil
+	requestLines := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return
+		}
+		requestLines <- strings.TrimSuffix(line, "\r\n")
+		_, _ = io.WriteString(conn, raw)
+	}()
+	return "http://" + listener.Addr().String(), requestLines
 }
 
 func TestHTTPBinProxyChunked(t *testing.T) {
 	t.Run("proxy writes chunked response with headers", func(t *testing.T) {
-		origTransport := http.DefaultTransport
-		t.Cleanup(func() {
-			http.DefaultTransport = origTransport
-		})
-
 		chunks := [][]byte{
 			[]byte("hello"),
 			[]byte(" "),
 			[]byte("world"),
 		}
-		http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
-			if r.URL.Scheme != "https" {
-				t.Fatalf("unexpected scheme: %q", r.URL.Scheme)
-			}
-			if r.URL.Host != "httpbin.org" {
-				t.Fatalf("unexpected host: %q", r.URL.Host)
-			}
-			if r.URL.Path != "/test" {
-				t.Fatalf("unexpected path: %q", r.URL.Path)
-			}
-			return &http.Response{
-				StatusCode:    http.StatusOK,
-				Status:        "200 OK",
-				Header:        http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"11"}},
-				Body:          &chunkedBody{chunks: chunks},
-				ContentLength: 11,
-			}, nil
-		})
+		upstream, requestLines := startUpstream(t, "HTTP/1.1 200 OK\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"Connection: close, X-Hop\r\n"+
+			"X-Hop: 1\r\n"+
+			"Transfer-Encoding: chunked\r\n"+
+			"\r\n"+
+			"5\r\nhello\r\n1\r\n \r\n5\r\nworld\r\n0\r\n\r\n")
 
-		handler := newHandler()
+		handler, err := newHandler(context.Background(), upstream, client.New())
+		if err != nil {
+			t.Fatalf("newHandler returned error: %v", err)
+		}
 		req := &request.Request{
 			RequestLine: request.RequestLine{
-				RequestTarget: "/httpbin/test",
+				Method:        "GET",
+				RequestTarget: "/httpbin/test?n=1",
+				Target: request.Target{
+					Path:     "/httpbin/test",
+					RawPath:  "/httpbin/test",
+					RawQuery: "n=1",
+				},
 			},
 		}
 
 		var buf bytes.Buffer
 		handler(response.NewWriter(&buf), req)
 
+		if line := <-requestLines; line != "GET /test?n=1 HTTP/1.1" {
+			t.Fatalf("unexpected upstream request line: %q", line)
+		}
 		statusLine, headers, body := splitResponse(t, buf.Bytes())
 		if statusLine != "HTTP/1.1 200 OK" {
 			t.Fatalf("unexpected status line: %q", statusLine)
@@ -90,23 +97,150 @@ func TestHTTPBinProxyChunked(t *testing.T) {
 		if headers["content-type"] != "text/plain" {
 			t.Fatalf("unexpected Content-Type: %q", headers["content-type"])
 		}
+		for _, name := range []string{"connection", "x-hop"} {
+			if _, ok := headers[name]; ok {
+				t.Fatalf("hop-by-hop header was proxied: %s", name)
+			}
+		}
 
 		chunkSizes, payload := parseChunkedBody(t, body)
 		expectedBody := bytes.Join(chunks, nil)
 		if !bytes.Equal(payload, expectedBody) {
 			t.Fatalf("unexpected body: %q", payload)
 		}
-		if len(chunkSizes) != len(chunks) {
-			t.Fatalf("unexpected chunk count: %d", len(chunkSizes))
+		total := 0
+		for _, size := range chunkSizes {
+			total += size
+		}
+		if total != len(expectedBody) {
+			t.Fatalf("unexpected chunk sizes: %v", chunkSizes)
 		}
-		for i, size := range chunkSizes {
-			if size != len(chunks[i]) {
-				t.Fatalf("unexpected chunk size at %d: %d", i, size)
+		wantTrailers := fmt.Sprintf("X-Content-SHA256: %x\r\nX-Content-Length: %d\r\n\r\n", sha256.Sum256(expectedBody), len(expectedBody))
+		if !strings.HasSuffix(buf.String(), wantTrailers) {
+			t.Fatalf("unexpected trailers: %q", buf.String())
+		}
+	})
+
+	t.Run("proxy aborts the upstream fetch when ctx is cancelled", func(t *testing.T) {
+		// The upstream accepts the request and never answers.
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = listener.Close()
+		})
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				accepted <- conn
 			}
+		}()
+		upstream := "http://" + listener.Addr().String()
+		ctx, cancel := context.WithCancel(context.Background())
+		handler, err := newHandler(ctx, upstream, client.New())
+		if err != nil {
+			t.Fatalf("newHandler returned error: %v", err)
+		}
+		req := &request.Request{
+			RequestLine: request.RequestLine{
+				Method:        "GET",
+				RequestTarget: "/httpbin/delay/10",
+				Target:        request.Target{Path: "/httpbin/delay/10", RawPath: "/httpbin/delay/10"},
+			},
+		}
+
+		done := make(chan struct{})
+		var buf bytes.Buffer
+		go func() {
+			defer close(done)
+			handler(response.NewWriter(&buf), req)
+		}()
+		conn := <-accepted
+		defer conn.Close()
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("handler didn't return after ctx was cancelled")
+		}
+		if !strings.HasPrefix(buf.String(), "HTTP/1.1 500 Internal Server Error\r\n") {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+	})
+
+	t.Run("proxy passes 304 on without framing", func(t *testing.T) {
+		upstream, _ := startUpstream(t, "HTTP/1.1 304 Not Modified\r\n"+
+			"ETag: \"v1\"\r\n"+
+			"Connection: close\r\n"+
+			"\r\n")
+
+		handler, err := newHandler(context.Background(), upstream, client.New())
+		if err != nil {
+			t.Fatalf("newHandler returned error: %v", err)
+		}
+		req := &request.Request{
+			RequestLine: request.RequestLine{
+				Method:        "GET",
+				RequestTarget: "/httpbin/etag/v1",
+				Target:        request.Target{Path: "/httpbin/etag/v1", RawPath: "/httpbin/etag/v1"},
+			},
+		}
+
+		var buf bytes.Buffer
+		w := response.NewWriter(&buf)
+		handler(w, req)
+		if err := w.Finish(); err != nil {
+			t.Fatalf("Finish returned error: %v", err)
+		}
+		if want := "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\n\r\n"; buf.String() != want {
+			t.Fatalf("unexpected response: %q", buf.String())
 		}
 	})
 }
 
+func TestRoutes(t *testing.T) {
+	handler, err := newHandler(context.Background(), "http://127.0.0.1:1", client.New())
+	if err != nil {
+		t.Fatalf("newHandler returned error: %v", err)
+	}
+
+	tests := []struct {
+		method, target string
+		wantStatus     response.StatusCode
+	}{
+		{"GET", "/", response.StatusOK},
+		{"GET", "/?x=1", response.StatusOK},
+		{"GET", "/yourproblem?x=1", response.StatusBadRequest},
+		{"GET", "/myproblem", response.StatusInternalServerError},
+		{"GET", "/nope", response.StatusNotFound},
+		{"POST", "/", response.StatusMethodNotAllowed},
+		{"OPTIONS", "/video", response.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			req, err := request.RequestFromReader(strings.NewReader(tt.method + " " + tt.target + " HTTP/1.1\r\nHost: test\r\n\r\n"))
+			if err != nil {
+				t.Fatalf("parsing request: %v", err)
+			}
+			var buf bytes.Buffer
+			w := response.NewWriter(&buf)
+			handler(w, req)
+			if err := w.Finish(); err != nil {
+				t.Fatalf("Finish returned error: %v", err)
+			}
+			resp, err := response.ResponseFromReader(&buf, tt.method)
+			if err != nil {
+				t.Fatalf("parsing response: %v", err)
+			}
+			if resp.StatusLine.StatusCode != tt.wantStatus {
+				t.Fatalf("unexpected status: %d", resp.StatusLine.StatusCode)
+			}
+		})
+	}
+}
+
 func splitResponse(t *testing.T, data []byte) (string, map[string]string, []byte) {
 	t.Helper()
 
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"io"
+)
+
+// body hands the connection back to the client once the response body has
+// been read to the end, and closes it if the caller gives up earlier.
+type body struct {
+	io.ReadCloser
+	ctx      context.Context
+	client   *Client
+	conn     *persistConn
+	stop     func() bool
+	reusable bool
+	done     bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.finish(b.reusable)
+	} else if err != nil {
+		b.finish(false)
+		if ctxErr := b.ctx.Err(); ctxErr != nil {
+			return n, ctxErr
+		}
+	}
+	return n, err
+}
+
+// Close releases the connection. A body that has already ended, as those of
+// HEAD and 204 responses do, still lets the connection be reused.
+func (b *body) Close() error {
+	if b.done {
+		return nil
+	}
+	_, err := b.ReadCloser.Read(nil)
+	b.finish(err == io.EOF && b.reusable)
+	return nil
+}
+
+func (b *body) finish(reuse bool) {
+	b.done = true
+	// stop reports false once the context's deadline was forced onto the
+	// connection, which leaves it unusable.
+	if !b.stop() || !reuse {
+		_ = b.conn.conn.Close()
+		return
+	}
+	b.client.putIdle(b.conn)
+}
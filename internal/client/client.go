@@ -0,0 +1,383 @@
+// Package client is an HTTP/1.1 client that speaks to servers over plain TCP
+// connections using the request and response packages of this module.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glebson1988/httpfromtcp/internal/headers"
+	"github.com/glebson1988/httpfromtcp/internal/request"
+	"github.com/glebson1988/httpfromtcp/internal/response"
+)
+
+const (
+	defaultDialTimeout    = 10 * time.Second
+	defaultReadTimeout    = 30 * time.Second
+	defaultWriteTimeout   = 30 * time.Second
+	defaultIdleTimeout    = 90 * time.Second
+	defaultMaxIdlePerHost = 2
+)
+
+// Client sends requests and keeps idle keep-alive connections per host for
+// reuse. A zero timeout means none. The fields must not be changed once the
+// client is in use.
+type Client struct {
+	DialTimeout time.Duration
+	// ReadTimeout bounds each read from the connection, so it limits how long
+	// the server may stay silent, not how long a whole body may take.
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	IdleTimeout    time.Duration
+	MaxIdlePerHost int
+	// TLSConfig is used for https targets. ServerName defaults to the host.
+	TLSConfig *tls.Config
+
+	mu   sync.Mutex
+	idle map[string][]*persistConn
+}
+
+func New() *Client {
+	return &Client{
+		DialTimeout:    defaultDialTimeout,
+		ReadTimeout:    defaultReadTimeout,
+		WriteTimeout:   defaultWriteTimeout,
+		IdleTimeout:    defaultIdleTimeout,
+		MaxIdlePerHost: defaultMaxIdlePerHost,
+	}
+}
+
+// NewRequest builds a request for an absolute http or https URL. The target is
+// kept in absolute form so Do knows where to connect, while the request line
+// carries the origin form servers expect. Spaces and non-ASCII bytes in the
+// query are percent-encoded; Request.Write refuses a method or target that
+// would still break the request line.
+func NewRequest(method, rawURL string, body []byte) (*request.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in %q", rawURL)
+	}
+	requestTarget := u.EscapedPath()
+	if requestTarget == "" {
+		requestTarget = "/"
+	}
+	rawQuery := escapeQuery(u.RawQuery)
+	if rawQuery != "" {
+		requestTarget += "?" + rawQuery
+	}
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        method,
+			RequestTarget: requestTarget,
+			HttpVersion:   "1.1",
+			Target: request.Target{
+				Form:     request.AbsoluteForm,
+				Scheme:   u.Scheme,
+				Host:     u.Host,
+				Path:     u.Path,
+				RawPath:  u.EscapedPath(),
+				RawQuery: rawQuery,
+			},
+		},
+		Headers: headers.Headers{{Name: "Host", Value: u.Host}},
+		Body:    body,
+	}, nil
+}
+
+// escapeQuery percent-encodes the bytes url.Parse leaves in a raw query that
+// can't appear in a request target. Existing escapes are kept as they are.
+func escapeQuery(query string) string {
+	var b strings.Builder
+	for i := 0; i < len(query); i++ {
+		if c := query[i]; c <= ' ' || c >= 0x7f {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Get sends a GET request for rawURL.
+func (c *Client) Get(ctx context.Context, rawURL string) (*response.Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(ctx, req)
+}
+
+// Do sends req to the host of its absolute-form target and returns the final
+// response once its headers have arrived. Interim 1xx responses are skipped.
+// The body streams from BodyReader, which the caller must close; the
+// connection goes back to the pool once the body has been read to the end.
+// Cancelling ctx aborts the exchange, including a body still being read.
+func (c *Client) Do(ctx context.Context, req *request.Request) (*response.Response, error) {
+	target := req.RequestLine.Target
+	if target.Form != request.AbsoluteForm {
+		return nil, fmt.Errorf("request target must be in absolute form")
+	}
+	key := target.Scheme + "://" + hostPort(target.Scheme, target.Host)
+
+	for {
+		pc, reused, err := c.getConn(ctx, key, target)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.roundTrip(ctx, pc, req)
+		if err == nil {
+			return resp, nil
+		}
+		// A pooled connection the server already closed fails before any
+		// response byte arrives, so the request is sent again on a new one,
+		// as long as that can't make the server act on it twice.
+		if reused && ctx.Err() == nil && canRetry(req, err) {
+			continue
+		}
+		return nil, err
+	}
+}
+
+var (
+	errNotSent   = errors.New("connection closed before the request was sent")
+	errStaleConn = errors.New("connection closed before a response arrived")
+)
+
+// canRetry reports whether req may be sent again after err on a reused
+// connection. Its body must be replayable, so it can't come from BodyReader.
+// A request that never reached the connection is always safe to resend;
+// one that may have been processed only if its method is idempotent.
+func canRetry(req *request.Request, err error) bool {
+	if req.BodyReader != nil {
+		return false
+	}
+	if errors.Is(err, errNotSent) {
+		return true
+	}
+	return errors.Is(err, errStaleConn) && idempotent(req.RequestLine.Method)
+}
+
+// idempotent reports whether method is idempotent per RFC 9110 section 9.2.2.
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func (c *Client) roundTrip(ctx context.Context, pc *persistConn, req *request.Request) (*response.Response, error) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = pc.conn.SetDeadline(time.Now())
+	})
+	fail := func(err error) (*response.Response, error) {
+		stop()
+		_ = pc.conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+
+	if err := pc.conn.SetWriteDeadline(deadline(c.WriteTimeout)); err != nil {
+		return fail(err)
+	}
+	cw := &countingWriter{w: pc.conn}
+	bw := bufio.NewWriter(cw)
+	err := req.Write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	switch {
+	case err == nil:
+	case cw.err == nil:
+		// The request itself failed, not the connection.
+		return fail(err)
+	case cw.n == 0:
+		return fail(fmt.Errorf("%w: %w", errNotSent, err))
+	default:
+		return fail(fmt.Errorf("%w: %w", errStaleConn, err))
+	}
+
+	for {
+		resp, err := pc.reader.ReadResponse(req.RequestLine.Method)
+		if err == io.EOF {
+			return fail(errStaleConn)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if resp.IsInterim() {
+			continue
+		}
+		resp.BodyReader = &body{
+			ReadCloser: resp.BodyReader,
+			ctx:        ctx,
+			client:     c,
+			conn:       pc,
+			stop:       stop,
+			reusable:   resp.KeepAlive() && !req.Headers.HasToken("connection", "close") && !isUpgrade(resp),
+		}
+		return resp, nil
+	}
+}
+
+func isUpgrade(resp *response.Response) bool {
+	return resp.StatusLine.StatusCode == response.StatusSwitchingProtocols
+}
+
+func (c *Client) getConn(ctx context.Context, key string, target request.Target) (*persistConn, bool, error) {
+	if pc := c.takeIdle(key); pc != nil {
+		return pc, true, nil
+	}
+	pc, err := c.dial(ctx, key, target)
+	return pc, false, err
+}
+
+func (c *Client) dial(ctx context.Context, key string, target request.Target) (*persistConn, error) {
+	dialer := net.Dialer{Timeout: c.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort(target.Scheme, target.Host))
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme == "https" {
+		config := &tls.Config{}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(hostPort(target.Scheme, target.Host))
+			if err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(conn, config)
+		handshakeCtx := ctx
+		if c.DialTimeout > 0 {
+			var cancel context.CancelFunc
+			handshakeCtx, cancel = context.WithTimeout(ctx, c.DialTimeout)
+			defer cancel()
+		}
+		if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	pc := &persistConn{key: key, conn: conn}
+	pc.reader = response.NewReader(&deadlineReader{conn: conn, timeout: c.ReadTimeout})
+	return pc, nil
+}
+
+func (c *Client) takeIdle(key string) *persistConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conns := c.idle[key]; len(conns) > 0; conns = c.idle[key] {
+		pc := conns[len(conns)-1]
+		c.idle[key] = conns[:len(conns)-1]
+		if c.IdleTimeout > 0 && time.Since(pc.idleSince) > c.IdleTimeout {
+			_ = pc.conn.Close()
+			continue
+		}
+		return pc
+	}
+	return nil
+}
+
+func (c *Client) putIdle(pc *persistConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle[pc.key]) >= c.MaxIdlePerHost {
+		_ = pc.conn.Close()
+		return
+	}
+	if c.idle == nil {
+		c.idle = make(map[string][]*persistConn)
+	}
+	pc.idleSince = time.Now()
+	c.idle[pc.key] = append(c.idle[pc.key], pc)
+}
+
+// CloseIdleConnections closes every pooled connection.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, conns := range c.idle {
+		for _, pc := range conns {
+			_ = pc.conn.Close()
+		}
+		delete(c.idle, key)
+	}
+}
+
+type persistConn struct {
+	key       string
+	conn      net.Conn
+	reader    *response.Reader
+	idleSince time.Time
+}
+
+// countingWriter counts the bytes the connection accepted and keeps its
+// first error, to tell whether any part of a request may have been sent.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// deadlineReader renews the read deadline before every read.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if err := r.conn.SetReadDeadline(deadline(r.timeout)); err != nil {
+		return 0, err
+	}
+	return r.conn.Read(p)
+}
+
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func hostPort(scheme, host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if scheme == "https" {
+		return net.JoinHostPort(host, "443")
+	}
+	return net.JoinHostPort(host, "80")
+}
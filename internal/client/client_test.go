@@ -0,0 +1,363 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glebson1988/httpfromtcp/internal/request"
+	"github.com/glebson1988/httpfromtcp/internal/response"
+)
+
+// testServer accepts connections and answers each request on them with
+// handle until it returns false.
+type testServer struct {
+	listener net.Listener
+	accepted atomic.Int32
+}
+
+func startServer(t *testing.T, handle func(w *response.Writer, req *request.Request) bool) *testServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &testServer{listener: listener}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			srv.accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				reader := request.NewReader(conn)
+				for {
+					req, err := reader.ReadRequest()
+					if err != nil {
+						return
+					}
+					if _, err := req.ReadBody(); err != nil {
+						return
+					}
+					writer := response.NewWriter(conn)
+					keep := handle(writer, req)
+					if err := writer.Finish(); err != nil || !keep || writer.ShouldClose() {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return srv
+}
+
+func (s *testServer) url(path string) string {
+	return "http://" + s.listener.Addr().String() + path
+}
+
+func readAll(t *testing.T, resp *response.Response) string {
+	t.Helper()
+	defer resp.BodyReader.Close()
+	data, err := io.ReadAll(resp.BodyReader)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	return string(data)
+}
+
+func TestClientReusesConnections(t *testing.T) {
+	srv := startServer(t, func(w *response.Writer, req *request.Request) bool {
+		_, _ = io.WriteString(w, "path="+req.RequestLine.RequestTarget)
+		return true
+	})
+	c := New()
+	defer c.CloseIdleConnections()
+
+	for _, path := range []string{"/one", "/two?x=1", "/three"} {
+		resp, err := c.Get(context.Background(), srv.url(path))
+		if err != nil {
+			t.Fatalf("Get returned error: %v", err)
+		}
+		if resp.StatusLine.StatusCode != response.StatusOK {
+			t.Fatalf("unexpected status: %d", resp.StatusLine.StatusCode)
+		}
+		if body := readAll(t, resp); body != "path="+path {
+			t.Fatalf("unexpected body: %q", body)
+		}
+	}
+	if n := srv.accepted.Load(); n != 1 {
+		t.Fatalf("expected one connection, got %d", n)
+	}
+}
+
+func TestClientStreamsChunkedBodies(t *testing.T) {
+	srv := startServer(t, func(w *response.Writer, req *request.Request) bool {
+		_, _ = io.WriteString(w, "first ")
+		_ = w.Flush()
+		_, _ = io.WriteString(w, "second")
+		return true
+	})
+	c := New()
+	defer c.CloseIdleConnections()
+
+	resp, err := c.Get(context.Background(), srv.url("/"))
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if resp.Headers.Get("Transfer-Encoding") != "chunked" {
+		t.Fatalf("expected a chunked response, got %v", resp.Headers)
+	}
+	if body := readAll(t, resp); body != "first second" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func TestClientSendsBody(t *testing.T) {
+	srv := startServer(t, func(w *response.Writer, req *request.Request) bool {
+		_, _ = w.Write(req.Body)
+		return true
+	})
+	c := New()
+	defer c.CloseIdleConnections()
+
+	req, err := NewRequest("POST", srv.url("/echo"), []byte("payload"))
+	if err != nil {
+		t.Fatalf("NewRequest returned error: %v", err)
+	}
+	resp, err := c.Do(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Do returned error: %v", err)
+	}
+	if body := readAll(t, resp); body != "payload" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func TestClientConnectionClose(t *testing.T) {
+	srv := startServer(t, func(w *response.Writer, req *request.Request) bool {
+		w.CloseAfterResponse()
+		_, _ = io.WriteString(w, "bye")
+		return false
+	})
+	c := New()
+	defer c.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(context.Background(), srv.url("/"))
+		if err != nil {
+			t.Fatalf("Get returned error: %v", err)
+		}
+		readAll(t, resp)
+	}
+	if n := srv.accepted.Load(); n != 2 {
+		t.Fatalf("expected two connections, got %d", n)
+	}
+}
+
+func TestClientRetriesStaleConnection(t *testing.T) {
+	// The server silently drops every connection after one response, the way
+	// an idle timeout on the server side would.
+	srv := startServer(t, func(w *response.Writer, req *request.Request) bool {
+		_, _ = io.WriteString(w, "ok")
+		return false
+	})
+	c := New()
+	defer c.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(context.Background(), srv.url("/"))
+		if err != nil {
+			t.Fatalf("Get %d returned error: %v", i, err)
+		}
+		if body := readAll(t, resp); body != "ok" {
+			t.Fatalf("unexpected body: %q", body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestClientDoesNotReplayPost(t *testing.T) {
+	// The server answers the first request and keeps the connection, then
+	// reads the POST that reuses it and drops the connection without an
+	// answer, as if it crashed after acting on the request.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	var posts atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := request.NewReader(conn)
+				for {
+					req, err := reader.ReadRequest()
+					if err != nil {
+						return
+					}
+					if _, err := req.ReadBody(); err != nil {
+						return
+					}
+					if req.RequestLine.Method == "POST" {
+						posts.Add(1)
+						return
+					}
+					writer := response.NewWriter(conn)
+					_, _ = io.WriteString(writer, "ok")
+					if err := writer.Finish(); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	url := "http://" + listener.Addr().String() + "/"
+	c := New()
+	defer c.CloseIdleConnections()
+
+	resp, err := c.Get(context.Background(), url)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	readAll(t, resp)
+
+	req, err := NewRequest("POST", url, []byte("payload"))
+	if err != nil {
+		t.Fatalf("NewRequest returned error: %v", err)
+	}
+	if _, err := c.Do(context.Background(), req); !errors.Is(err, errStaleConn) {
+		t.Fatalf("expected errStaleConn, got %v", err)
+	}
+	if n := posts.Load(); n != 1 {
+		t.Fatalf("expected the POST to reach the server once, got %d", n)
+	}
+}
+
+func TestClientUnreadBodyClosesConnection(t *testing.T) {
+	srv := startServer(t, func(w *response.Writer, req *request.Request) bool {
+		_, _ = io.WriteString(w, "not read")
+		return true
+	})
+	c := New()
+	defer c.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(context.Background(), srv.url("/"))
+		if err != nil {
+			t.Fatalf("Get returned error: %v", err)
+		}
+		_ = resp.BodyReader.Close()
+	}
+	if n := srv.accepted.Load(); n != 2 {
+		t.Fatalf("expected two connections, got %d", n)
+	}
+}
+
+func TestClientHeadReusesConnection(t *testing.T) {
+	srv := startServer(t, func(w *response.Writer, req *request.Request) bool {
+		w.SetRequestMethod(req.RequestLine.Method)
+		_, _ = io.WriteString(w, "body")
+		return true
+	})
+	c := New()
+	defer c.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		req, err := NewRequest("HEAD", srv.url("/"), nil)
+		if err != nil {
+			t.Fatalf("NewRequest returned error: %v", err)
+		}
+		resp, err := c.Do(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Do returned error: %v", err)
+		}
+		if resp.Headers.Get("Content-Length") != "4" {
+			t.Fatalf("unexpected headers: %v", resp.Headers)
+		}
+		_ = resp.BodyReader.Close()
+	}
+	if n := srv.accepted.Load(); n != 1 {
+		t.Fatalf("expected one connection, got %d", n)
+	}
+}
+
+func TestClientTimeoutsAndCancellation(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() {
+		close(release)
+	})
+	srv := startServer(t, func(w *response.Writer, req *request.Request) bool {
+		<-release
+		return false
+	})
+
+	t.Run("read timeout", func(t *testing.T) {
+		c := New()
+		c.ReadTimeout = 50 * time.Millisecond
+		_, err := c.Get(context.Background(), srv.url("/"))
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatalf("expected a timeout, got %v", err)
+		}
+	})
+
+	t.Run("context cancellation", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		_, err := New().Get(ctx, srv.url("/"))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	})
+}
+
+func TestNewRequest(t *testing.T) {
+	req, err := NewRequest("GET", "https://example.com/a%20b?q=1", nil)
+	if err != nil {
+		t.Fatalf("NewRequest returned error: %v", err)
+	}
+	if req.RequestLine.RequestTarget != "/a%20b?q=1" {
+		t.Fatalf("unexpected request target: %q", req.RequestLine.RequestTarget)
+	}
+	if req.Headers.Get("Host") != "example.com" {
+		t.Fatalf("unexpected Host: %q", req.Headers.Get("Host"))
+	}
+	if got := hostPort(req.RequestLine.Target.Scheme, req.RequestLine.Target.Host); got != "example.com:443" {
+		t.Fatalf("unexpected address: %q", got)
+	}
+
+	if _, err := NewRequest("GET", "ftp://example.com/", nil); err == nil {
+		t.Fatalf("expected an error for an unsupported scheme")
+	}
+
+	req, err = NewRequest("GET", "http://example.com/?a b=%41\u00e9", nil)
+	if err != nil {
+		t.Fatalf("NewRequest returned error: %v", err)
+	}
+	if req.RequestLine.RequestTarget != "/?a%20b=%41%C3%A9" || req.RequestLine.Target.RawQuery != "a%20b=%41%C3%A9" {
+		t.Fatalf("query wasn't escaped: %q", req.RequestLine.RequestTarget)
+	}
+
+	req, err = NewRequest("GET /admin", "http://example.com/", nil)
+	if err != nil {
+		t.Fatalf("NewRequest returned error: %v", err)
+	}
+	if err := req.Write(io.Discard); err == nil {
+		t.Fatalf("expected Write to refuse an invalid method")
+	}
+}
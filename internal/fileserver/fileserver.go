@@ -0,0 +1,156 @@
+// Package fileserver streams files and other seekable content as responses,
+// answering Range requests with partial content.
+package fileserver
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/glebson1988/httpfromtcp/internal/request"
+	"github.com/glebson1988/httpfromtcp/internal/response"
+)
+
+// ServeFile streams the file at path as the response to req. A missing file
+// gets a 404 and any other failure to open it a 500.
+func ServeFile(w *response.Writer, req *request.Request, path, contentType string) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, response.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil {
+		writeError(w, response.StatusInternalServerError, "failed to open file")
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, response.StatusInternalServerError, "failed to read file")
+		return
+	}
+	if info.IsDir() {
+		writeError(w, response.StatusNotFound, "file not found")
+		return
+	}
+	ServeContent(w, req, f, info.Size(), info.ModTime(), contentType)
+}
+
+// ServeContent answers req with size bytes of content. Conditional requests
+// are evaluated first against modTime and any ETag already set on w, and may
+// be answered with 304 or 412 without reading content. A satisfiable Range
+// on a GET or HEAD request gets a 206 with the single range, or with every
+// range as multipart/byteranges, and an unsatisfiable one gets a 416. The
+// Range is ignored, and the whole content sent with a 200, when it is
+// malformed or when If-Range no longer matches the ETag set on w or modTime.
+// A zero modTime omits Last-Modified.
+func ServeContent(w *response.Writer, req *request.Request, content io.ReadSeeker, size int64, modTime time.Time, contentType string) {
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	if !modTime.IsZero() {
+		w.SetLastModified(modTime)
+	}
+	w.SetRequestHeaders(req.Headers)
+	if !w.CheckPreconditions() {
+		return
+	}
+
+	ranges, err := requestedRanges(req, h.Get("ETag"), size, modTime)
+	if errors.Is(err, errUnsatisfiable) {
+		h.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		writeError(w, response.StatusRangeNotSatisfiable, "requested range not satisfiable")
+		return
+	}
+
+	switch len(ranges) {
+	case 0:
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		w.SetStatus(response.StatusOK)
+		if !w.IsHead() {
+			_ = copyRange(w, content, byteRange{start: 0, length: size})
+		}
+	case 1:
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Range", ranges[0].contentRange(size))
+		h.Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		w.SetStatus(response.StatusPartialContent)
+		if !w.IsHead() {
+			_ = copyRange(w, content, ranges[0])
+		}
+	default:
+		boundary := multipart.NewWriter(io.Discard).Boundary()
+		h.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+		h.Set("Content-Length", strconv.FormatInt(multipartLength(ranges, boundary, contentType, size), 10))
+		w.SetStatus(response.StatusPartialContent)
+		if !w.IsHead() {
+			_ = writeMultipart(w, content, ranges, boundary, contentType, size)
+		}
+	}
+}
+
+func copyRange(w io.Writer, content io.ReadSeeker, r byteRange) error {
+	if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, content, r.length)
+	return err
+}
+
+func writeMultipart(w io.Writer, content io.ReadSeeker, ranges []byteRange, boundary, contentType string, size int64) error {
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		part, err := mw.CreatePart(r.partHeader(contentType, size))
+		if err != nil {
+			return err
+		}
+		if err := copyRange(part, content, r); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// multipartLength works out the Content-Length of the multipart body ahead of
+// sending it by writing the part headers without the content.
+func multipartLength(ranges []byteRange, boundary, contentType string, size int64) int64 {
+	var cw countingWriter
+	mw := multipart.NewWriter(&cw)
+	_ = mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		_, _ = mw.CreatePart(r.partHeader(contentType, size))
+		cw.n += r.length
+	}
+	_ = mw.Close()
+	return cw.n
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func (r byteRange) partHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {contentType},
+		"Content-Range": {r.contentRange(size)},
+	}
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, message string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.SetStatus(statusCode)
+	_, _ = io.WriteString(w, message)
+}
@@ -0,0 +1,321 @@
+package fileserver
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebson1988/httpfromtcp/internal/headers"
+	"github.com/glebson1988/httpfromtcp/internal/request"
+	"github.com/glebson1988/httpfromtcp/internal/response"
+)
+
+const content = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+var modTime = time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+func serve(t *testing.T, method string, fields headers.Headers, setup func(w *response.Writer)) *response.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	w.SetRequestMethod(method)
+	if setup != nil {
+		setup(w)
+	}
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: "/file", HttpVersion: "1.1"},
+		Headers:     fields,
+	}
+	ServeContent(w, req, strings.NewReader(content), int64(len(content)), modTime, "text/plain")
+	if err := w.Finish(); err != nil {
+		t.Fatalf("Finish returned error: %v", err)
+	}
+
+	resp, err := response.ResponseFromReader(&buf, method)
+	if err != nil {
+		t.Fatalf("parsing response: %v", err)
+	}
+	return resp
+}
+
+func TestServeContent(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		fields       headers.Headers
+		wantStatus   response.StatusCode
+		wantRange    string
+		wantBody     string
+		wantLength   string
+		setupETagged bool
+	}{
+		{
+			name:       "no Range",
+			method:     "GET",
+			wantStatus: response.StatusOK,
+			wantBody:   content,
+			wantLength: "36",
+		},
+		{
+			name:       "single range",
+			method:     "GET",
+			fields:     headers.Headers{{Name: "Range", Value: "bytes=0-4"}},
+			wantStatus: response.StatusPartialContent,
+			wantRange:  "bytes 0-4/36",
+			wantBody:   "01234",
+			wantLength: "5",
+		},
+		{
+			name:       "open ended range",
+			method:     "GET",
+			fields:     headers.Headers{{Name: "Range", Value: "bytes=30-"}},
+			wantStatus: response.StatusPartialContent,
+			wantRange:  "bytes 30-35/36",
+			wantBody:   "uvwxyz",
+			wantLength: "6",
+		},
+		{
+			name:       "suffix range",
+			method:     "GET",
+			fields:     headers.Headers{{Name: "Range", Value: "bytes=-3"}},
+			wantStatus: response.StatusPartialContent,
+			wantRange:  "bytes 33-35/36",
+			wantBody:   "xyz",
+			wantLength: "3",
+		},
+		{
+			name:       "range past the end is clamped",
+			method:     "GET",
+			fields:     headers.Headers{{Name: "Range", Value: "bytes=34-100"}},
+			wantStatus: response.StatusPartialContent,
+			wantRange:  "bytes 34-35/36",
+			wantBody:   "yz",
+			wantLength: "2",
+		},
+		{
+			name:       "unsatisfiable range",
+			method:     "GET",
+			fields:     headers.Headers{{Name: "Range", Value: "bytes=36-40"}},
+			wantStatus: response.StatusRangeNotSatisfiable,
+			wantRange:  "bytes */36",
+			wantBody:   "requested range not satisfiable",
+		},
+		{
+			name:       "malformed Range is ignored",
+			method:     "GET",
+			fields:     headers.Headers{{Name: "Range", Value: "bytes=5-1"}},
+			wantStatus: response.StatusOK,
+			wantBody:   content,
+			wantLength: "36",
+		},
+		{
+			name:       "other units are ignored",
+			method:     "GET",
+			fields:     headers.Headers{{Name: "Range", Value: "items=0-1"}},
+			wantStatus: response.StatusOK,
+			wantBody:   content,
+			wantLength: "36",
+		},
+		{
+			name:       "Range is ignored for POST",
+			method:     "POST",
+			fields:     headers.Headers{{Name: "Range", Value: "bytes=0-1"}},
+			wantStatus: response.StatusOK,
+			wantBody:   content,
+			wantLength: "36",
+		},
+		{
+			name:   "If-Range with the current date",
+			method: "GET",
+			fields: headers.Headers{
+				{Name: "Range", Value: "bytes=0-1"},
+				{Name: "If-Range", Value: headers.FormatTime(modTime)},
+			},
+			wantStatus: response.StatusPartialContent,
+			wantRange:  "bytes 0-1/36",
+			wantBody:   "01",
+			wantLength: "2",
+		},
+		{
+			name:   "If-Range with an old date",
+			method: "GET",
+			fields: headers.Headers{
+				{Name: "Range", Value: "bytes=0-1"},
+				{Name: "If-Range", Value: headers.FormatTime(modTime.Add(-time.Hour))},
+			},
+			wantStatus: response.StatusOK,
+			wantBody:   content,
+			wantLength: "36",
+		},
+		{
+			name:   "If-Range with the current ETag",
+			method: "GET",
+			fields: headers.Headers{
+				{Name: "Range", Value: "bytes=0-1"},
+				{Name: "If-Range", Value: `"v1"`},
+			},
+			setupETagged: true,
+			wantStatus:   response.StatusPartialContent,
+			wantRange:    "bytes 0-1/36",
+			wantBody:     "01",
+			wantLength:   "2",
+		},
+		{
+			name:   "If-Range with a weak ETag",
+			method: "GET",
+			fields: headers.Headers{
+				{Name: "Range", Value: "bytes=0-1"},
+				{Name: "If-Range", Value: `W/"v1"`},
+			},
+			setupETagged: true,
+			wantStatus:   response.StatusOK,
+			wantBody:     content,
+			wantLength:   "36",
+		},
+		{
+			name:       "HEAD with a range",
+			method:     "HEAD",
+			fields:     headers.Headers{{Name: "Range", Value: "bytes=0-4"}},
+			wantStatus: response.StatusPartialContent,
+			wantRange:  "bytes 0-4/36",
+			wantLength: "5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var setup func(w *response.Writer)
+			if tt.setupETagged {
+				setup = func(w *response.Writer) {
+					w.Header().Set("ETag", `"v1"`)
+				}
+			}
+			resp := serve(t, tt.method, tt.fields, setup)
+			if resp.StatusLine.StatusCode != tt.wantStatus {
+				t.Fatalf("unexpected status: %d", resp.StatusLine.StatusCode)
+			}
+			if got := resp.Headers.Get("Content-Range"); got != tt.wantRange {
+				t.Fatalf("unexpected Content-Range: %q", got)
+			}
+			if string(resp.Body) != tt.wantBody {
+				t.Fatalf("unexpected body: %q", resp.Body)
+			}
+			if tt.wantLength != "" && resp.Headers.Get("Content-Length") != tt.wantLength {
+				t.Fatalf("unexpected Content-Length: %q", resp.Headers.Get("Content-Length"))
+			}
+			if resp.Headers.Get("Accept-Ranges") != "bytes" {
+				t.Fatalf("missing Accept-Ranges: %v", resp.Headers)
+			}
+			if resp.Headers.Get("Last-Modified") != "Fri, 01 Mar 2024 12:00:00 GMT" {
+				t.Fatalf("unexpected Last-Modified: %q", resp.Headers.Get("Last-Modified"))
+			}
+		})
+	}
+}
+
+func TestServeContentMultipleRanges(t *testing.T) {
+	resp := serve(t, "GET", headers.Headers{{Name: "Range", Value: "bytes=0-1, 10-12, -2"}}, nil)
+	if resp.StatusLine.StatusCode != response.StatusPartialContent {
+		t.Fatalf("unexpected status: %d", resp.StatusLine.StatusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Headers.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("unexpected Content-Type: %q", resp.Headers.Get("Content-Type"))
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(resp.Body), params["boundary"])
+	want := []struct{ contentRange, body string }{
+		{"bytes 0-1/36", "01"},
+		{"bytes 10-12/36", "abc"},
+		{"bytes 34-35/36", "yz"},
+	}
+	for _, w := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("reading part: %v", err)
+		}
+		body, _ := io.ReadAll(part)
+		if part.Header.Get("Content-Range") != w.contentRange || string(body) != w.body {
+			t.Fatalf("unexpected part: %q %q", part.Header.Get("Content-Range"), body)
+		}
+		if part.Header.Get("Content-Type") != "text/plain" {
+			t.Fatalf("unexpected part Content-Type: %q", part.Header.Get("Content-Type"))
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("expected the end of the parts, got %v", err)
+	}
+}
+
+func TestServeContentOverlappingRanges(t *testing.T) {
+	ranges := strings.TrimSuffix(strings.Repeat("0-35,", 3), ",")
+	resp := serve(t, "GET", headers.Headers{{Name: "Range", Value: "bytes=" + ranges}}, nil)
+	if resp.StatusLine.StatusCode != response.StatusOK || string(resp.Body) != content {
+		t.Fatalf("expected the whole content once, got %d %q", resp.StatusLine.StatusCode, resp.Body)
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus response.StatusCode
+		wantBody   string
+	}{
+		{"existing file", path, response.StatusPartialContent, "abc"},
+		{"missing file", filepath.Join(t.TempDir(), "missing"), response.StatusNotFound, "file not found"},
+		{"directory", t.TempDir(), response.StatusNotFound, "file not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := response.NewWriter(&buf)
+			req := &request.Request{
+				RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/file", HttpVersion: "1.1"},
+				Headers:     headers.Headers{{Name: "Range", Value: "bytes=10-12"}},
+			}
+			ServeFile(w, req, tt.path, "text/plain")
+			if err := w.Finish(); err != nil {
+				t.Fatalf("Finish returned error: %v", err)
+			}
+			resp, err := response.ResponseFromReader(&buf, "GET")
+			if err != nil {
+				t.Fatalf("parsing response: %v", err)
+			}
+			if resp.StatusLine.StatusCode != tt.wantStatus || string(resp.Body) != tt.wantBody {
+				t.Fatalf("unexpected response: %d %q", resp.StatusLine.StatusCode, resp.Body)
+			}
+		})
+	}
+}
+
+func TestServeContentConditional(t *testing.T) {
+	resp := serve(t, "GET", headers.Headers{
+		{Name: "If-Modified-Since", Value: headers.FormatTime(modTime)},
+		{Name: "Range", Value: "bytes=0-1"},
+	}, nil)
+	if resp.StatusLine.StatusCode != response.StatusNotModified || len(resp.Body) != 0 {
+		t.Fatalf("unexpected response: %d %q", resp.StatusLine.StatusCode, resp.Body)
+	}
+	if resp.Headers.Get("Last-Modified") == "" {
+		t.Fatalf("304 lost Last-Modified: %v", resp.Headers)
+	}
+
+	resp = serve(t, "GET", headers.Headers{
+		{Name: "If-Unmodified-Since", Value: headers.FormatTime(modTime.Add(-time.Hour))},
+	}, nil)
+	if resp.StatusLine.StatusCode != response.StatusPreconditionFailed {
+		t.Fatalf("unexpected status: %d", resp.StatusLine.StatusCode)
+	}
+}
@@ -0,0 +1,155 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glebson1988/httpfromtcp/internal/headers"
+	"github.com/glebson1988/httpfromtcp/internal/request"
+)
+
+// maxRanges caps how many ranges one request may ask for before the Range
+// field is ignored.
+const maxRanges = 100
+
+var (
+	errInvalidRange  = errors.New("invalid Range")
+	errUnsatisfiable = errors.New("range not satisfiable")
+)
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// requestedRanges returns the ranges to send in answer to req, or none if the
+// whole content should be sent. It fails with errUnsatisfiable only when the
+// request's ranges all lie past the end of the content.
+func requestedRanges(req *request.Request, etag string, size int64, modTime time.Time) ([]byteRange, error) {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		return nil, nil
+	}
+	value := req.Headers.Get("Range")
+	if value == "" {
+		return nil, nil
+	}
+	if ifRange := req.Headers.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, etag, modTime) {
+		return nil, nil
+	}
+
+	ranges, err := parseRange(value, size)
+	if errors.Is(err, errInvalidRange) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Overlapping ranges that add up to more than the content are a way to
+	// make the server send far more than it holds, so they get it only once.
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	if len(ranges) > maxRanges || total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// parseRange parses a "bytes=" Range value following RFC 9110 section 14.1.2
+// and clamps each range to size. Ranges that start past the end are dropped,
+// and errUnsatisfiable is returned if none are left.
+func parseRange(value string, size int64) ([]byteRange, error) {
+	unit, set, ok := strings.Cut(value, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, errInvalidRange
+	}
+
+	var ranges []byteRange
+	specs := 0
+	for _, spec := range strings.Split(set, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		specs++
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		if first == "" {
+			suffix, err := parseDigits(last)
+			if err != nil {
+				return nil, err
+			}
+			if suffix == 0 || size == 0 {
+				continue
+			}
+			suffix = min(suffix, size)
+			ranges = append(ranges, byteRange{start: size - suffix, length: suffix})
+			continue
+		}
+
+		start, err := parseDigits(first)
+		if err != nil {
+			return nil, err
+		}
+		end := size - 1
+		if last != "" {
+			lastPos, err := parseDigits(last)
+			if err != nil {
+				return nil, err
+			}
+			if lastPos < start {
+				return nil, errInvalidRange
+			}
+			end = min(end, lastPos)
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+	if specs == 0 {
+		return nil, errInvalidRange
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	return ranges, nil
+}
+
+func parseDigits(s string) (int64, error) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, errInvalidRange
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errInvalidRange
+	}
+	return n, nil
+}
+
+// ifRangeMatches evaluates an If-Range value against the representation's
+// current validators. An entity-tag must match strongly, and a date must be
+// exactly the modification time.
+func ifRangeMatches(value, etag string, modTime time.Time) bool {
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		return !strings.HasPrefix(value, "W/") && value == etag
+	}
+	t, err := headers.ParseTime(value)
+	if err != nil || modTime.IsZero() {
+		return false
+	}
+	return modTime.Truncate(time.Second).Equal(t)
+}
@@ -0,0 +1,35 @@
+package headers
+
+import (
+	"fmt"
+	"time"
+)
+
+// TimeFormat is the IMF-fixdate format of RFC 9110 section 5.6.7, the one
+// to send in fields such as Last-Modified.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// obsoleteTimeFormats are the RFC 850 and asctime formats recipients must
+// still accept.
+var obsoleteTimeFormats = []string{
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+// FormatTime formats t as an IMF-fixdate in UTC.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+// ParseTime parses an HTTP-date in any of the three formats of RFC 9110.
+func ParseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(TimeFormat, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range obsoleteTimeFormats {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid HTTP-date: %q", value)
+}
@@ -2,23 +2,107 @@ package headers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 )
 
-type Headers map[string]string
+// Field is a single field line. Name keeps the case it was sent or set with.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Headers holds field lines in the order they were added. Names are matched
+// case-insensitively and a name may occur more than once.
+type Headers []Field
 
 const emptyLine = "\r\n"
 
+var (
+	ErrWhitespaceBeforeColon = errors.New("whitespace between header name and colon")
+	ErrInvalidFieldName      = errors.New("invalid header field name")
+	ErrInvalidFieldValue     = errors.New("invalid header field value")
+	ErrObsFold               = errors.New("header line starts with whitespace")
+)
+
+// Get returns all values for key joined with ", ", the way repeated fields
+// combine into one list. Use Values for fields such as Set-Cookie that can't
+// be combined.
 func (h Headers) Get(key string) string {
-	return h[strings.ToLower(key)]
+	return strings.Join(h.Values(key), ", ")
+}
+
+func (h Headers) Values(key string) []string {
+	var values []string
+	for _, field := range h {
+		if strings.EqualFold(field.Name, key) {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+func (h Headers) Has(key string) bool {
+	for _, field := range h {
+		if strings.EqualFold(field.Name, key) {
+			return true
+		}
+	}
+	return false
 }
 
-func (h Headers) Set(key, value string) {
-	h[strings.ToLower(key)] = value
+func (h *Headers) Add(key, value string) {
+	*h = append(*h, Field{Name: key, Value: value})
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+// Set replaces every field named key with a single one, kept at the position
+// of the first of them.
+func (h *Headers) Set(key, value string) {
+	for i, field := range *h {
+		if strings.EqualFold(field.Name, key) {
+			(*h)[i] = Field{Name: key, Value: value}
+			*h = append((*h)[:i+1], (*h)[i+1:].without(key)...)
+			return
+		}
+	}
+	h.Add(key, value)
+}
+
+func (h *Headers) Del(key string) {
+	*h = h.without(key)
+}
+
+func (h Headers) Clone() Headers {
+	if h == nil {
+		return nil
+	}
+	return append(Headers{}, h...)
+}
+
+func (h Headers) without(key string) Headers {
+	kept := make(Headers, 0, len(h))
+	for _, field := range h {
+		if !strings.EqualFold(field.Name, key) {
+			kept = append(kept, field)
+		}
+	}
+	return kept
+}
+
+// HasToken reports whether the comma-separated list in the key field contains
+// token, compared case-insensitively.
+func (h Headers) HasToken(key, token string) bool {
+	for _, part := range strings.Split(h.Get(key), ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
 	lineEnd := bytes.Index(data, []byte(emptyLine))
 	if lineEnd == -1 {
 		return 0, false, nil
@@ -26,6 +110,12 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	if lineEnd == 0 {
 		return len(emptyLine), true, nil
 	}
+	// A line starting with whitespace is either an obsolete line folding of
+	// the previous value or whitespace after the start line. Either way it
+	// can't be taken as a field of its own.
+	if data[0] == ' ' || data[0] == '\t' {
+		return 0, false, fmt.Errorf("%w: %q", ErrObsFold, data[:lineEnd])
+	}
 
 	line := string(data[:lineEnd])
 	colonIndex := strings.IndexByte(line, ':')
@@ -35,29 +125,58 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 
 	keyPart := line[:colonIndex]
 	if strings.HasSuffix(keyPart, " ") || strings.HasSuffix(keyPart, "\t") {
-		return 0, false, fmt.Errorf("invalid header key: %s", keyPart)
+		return 0, false, fmt.Errorf("%w: %s", ErrWhitespaceBeforeColon, keyPart)
 	}
 
 	valuePart := line[colonIndex+1:]
 	key := strings.TrimSpace(keyPart)
 	value := strings.TrimSpace(valuePart)
-	if key == "" {
-		return 0, false, fmt.Errorf("invalid header key: %s", keyPart)
+	if !ValidFieldName(key) {
+		return 0, false, fmt.Errorf("%w: %q", ErrInvalidFieldName, keyPart)
 	}
-	if !isValidFieldName(key) {
-		return 0, false, fmt.Errorf("invalid header key: %s", keyPart)
+	if !ValidFieldValue(value) {
+		return 0, false, fmt.Errorf("%w for %s", ErrInvalidFieldValue, key)
 	}
 
-	lowerKey := strings.ToLower(key)
-	if existing, ok := h[lowerKey]; ok {
-		h[lowerKey] = existing + ", " + value
-	} else {
-		h[lowerKey] = value
-	}
+	h.Add(key, value)
 	return lineEnd + len(emptyLine), false, nil
 }
 
-func isValidFieldName(key string) bool {
+// Validate checks every field against ValidFieldName and ValidFieldValue.
+func (h Headers) Validate() error {
+	for _, field := range h {
+		if !ValidFieldName(field.Name) {
+			return fmt.Errorf("%w: %q", ErrInvalidFieldName, field.Name)
+		}
+		if !ValidFieldValue(field.Value) {
+			return fmt.Errorf("%w for %s", ErrInvalidFieldValue, field.Name)
+		}
+	}
+	return nil
+}
+
+// Write validates the fields and writes them in order, followed by the empty
+// line that ends a header or trailer section.
+func (h Headers) Write(w io.Writer) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	for _, field := range h {
+		if _, err := fmt.Fprintf(w, "%s: %s\r\n", field.Name, field.Value); err != nil {
+			return fmt.Errorf("failed to write header %s: %w", field.Name, err)
+		}
+	}
+	if _, err := io.WriteString(w, emptyLine); err != nil {
+		return fmt.Errorf("failed to write headers terminator: %w", err)
+	}
+	return nil
+}
+
+// ValidFieldName reports whether key is a non-empty RFC 9110 token.
+func ValidFieldName(key string) bool {
+	if key == "" {
+		return false
+	}
 	for i := 0; i < len(key); i++ {
 		ch := key[i]
 		if ch >= 'a' && ch <= 'z' {
@@ -78,3 +197,9 @@ func isValidFieldName(key string) bool {
 	}
 	return true
 }
+
+// ValidFieldValue reports whether value is free of CR, LF and NUL, the bytes
+// that would let a value end its field line or split the message.
+func ValidFieldValue(value string) bool {
+	return !strings.ContainsAny(value, "\r\n\x00")
+}
@@ -2,6 +2,7 @@ package headers
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -15,7 +16,7 @@ func TestHeadersParse(t *testing.T) {
 		require.NoError(t, err)
 		assert.False(t, done)
 		assert.Equal(t, len("Host: localhost:42069\r\n"), n)
-		assert.Equal(t, "localhost:42069", h["host"])
+		assert.Equal(t, "localhost:42069", h.Get("host"))
 	})
 
 	t.Run("Valid single header with extra whitespace", func(t *testing.T) {
@@ -25,7 +26,7 @@ func TestHeadersParse(t *testing.T) {
 		require.NoError(t, err)
 		assert.False(t, done)
 		assert.Equal(t, len("Host:\t localhost:42069 \r\n"), n)
-		assert.Equal(t, "localhost:42069", h["host"])
+		assert.Equal(t, "localhost:42069", h.Get("host"))
 	})
 
 	t.Run("No CRLF yet", func(t *testing.T) {
@@ -38,41 +39,51 @@ func TestHeadersParse(t *testing.T) {
 		assert.Empty(t, h)
 	})
 
-	t.Run("Valid header with leading whitespace", func(t *testing.T) {
+	t.Run("Invalid header with leading whitespace", func(t *testing.T) {
 		h := Headers{}
 		n, done, err := h.Parse([]byte("   Host: localhost:42069\r\n"))
 
-		require.NoError(t, err)
+		require.ErrorIs(t, err, ErrObsFold)
 		assert.False(t, done)
-		assert.Equal(t, len("   Host: localhost:42069\r\n"), n)
-		assert.Equal(t, "localhost:42069", h["host"])
+		assert.Equal(t, 0, n)
+		assert.Empty(t, h)
+	})
+
+	t.Run("Invalid folded header", func(t *testing.T) {
+		h := Headers{}
+		n, done, err := h.Parse([]byte("\tTransfer-Encoding: chunked\r\n"))
+
+		require.ErrorIs(t, err, ErrObsFold)
+		assert.False(t, done)
+		assert.Equal(t, 0, n)
+		assert.Empty(t, h)
 	})
 
 	t.Run("Valid 2 headers with existing headers", func(t *testing.T) {
-		h := Headers{"connection": "keep-alive"}
+		h := Headers{{Name: "Connection", Value: "keep-alive"}}
 
 		n, done, err := h.Parse([]byte("Host: localhost:42069\r\n"))
 		require.NoError(t, err)
 		assert.False(t, done)
 		assert.Equal(t, len("Host: localhost:42069\r\n"), n)
-		assert.Equal(t, "localhost:42069", h["host"])
-		assert.Equal(t, "keep-alive", h["connection"])
+		assert.Equal(t, "localhost:42069", h.Get("host"))
+		assert.Equal(t, "keep-alive", h.Get("connection"))
 
 		n, done, err = h.Parse([]byte("User-Agent: test\r\n"))
 		require.NoError(t, err)
 		assert.False(t, done)
 		assert.Equal(t, len("User-Agent: test\r\n"), n)
-		assert.Equal(t, "test", h["user-agent"])
+		assert.Equal(t, "test", h.Get("user-agent"))
 	})
 
 	t.Run("Valid header with existing key in map", func(t *testing.T) {
-		h := Headers{"set-person": "lane-loves-go"}
+		h := Headers{{Name: "Set-Person", Value: "lane-loves-go"}}
 
 		n, done, err := h.Parse([]byte("Set-Person: prime-loves-zig\r\n"))
 		require.NoError(t, err)
 		assert.False(t, done)
 		assert.Equal(t, len("Set-Person: prime-loves-zig\r\n"), n)
-		assert.Equal(t, "lane-loves-go, prime-loves-zig", h["set-person"])
+		assert.Equal(t, "lane-loves-go, prime-loves-zig", h.Get("set-person"))
 	})
 
 	t.Run("Valid done", func(t *testing.T) {
@@ -89,7 +100,7 @@ func TestHeadersParse(t *testing.T) {
 		h := Headers{}
 		n, done, err := h.Parse([]byte("Host : localhost:42069\r\n"))
 
-		require.Error(t, err)
+		require.ErrorIs(t, err, ErrWhitespaceBeforeColon)
 		assert.False(t, done)
 		assert.Equal(t, 0, n)
 		assert.Empty(t, h)
@@ -99,9 +110,109 @@ func TestHeadersParse(t *testing.T) {
 		h := Headers{}
 		n, done, err := h.Parse([]byte("H©st: localhost:42069\r\n"))
 
-		require.Error(t, err)
+		require.ErrorIs(t, err, ErrInvalidFieldName)
 		assert.False(t, done)
 		assert.Equal(t, 0, n)
 		assert.Empty(t, h)
 	})
 }
+
+func TestHeadersFields(t *testing.T) {
+	t.Run("Parse keeps every field in order and case", func(t *testing.T) {
+		h := Headers{}
+		data := []byte("Set-Cookie: a=1\r\nHost: localhost\r\nset-cookie: b=2\r\n\r\n")
+		for {
+			n, done, err := h.Parse(data)
+			require.NoError(t, err)
+			data = data[n:]
+			if done {
+				break
+			}
+		}
+
+		assert.Equal(t, Headers{
+			{Name: "Set-Cookie", Value: "a=1"},
+			{Name: "Host", Value: "localhost"},
+			{Name: "set-cookie", Value: "b=2"},
+		}, h)
+		assert.Equal(t, []string{"a=1", "b=2"}, h.Values("SET-COOKIE"))
+		assert.Equal(t, "a=1, b=2", h.Get("set-cookie"))
+	})
+
+	t.Run("Add, Set and Del", func(t *testing.T) {
+		h := Headers{}
+		h.Add("Vary", "Accept")
+		h.Add("Content-Type", "text/plain")
+		h.Add("vary", "Origin")
+		assert.Equal(t, []string{"Accept", "Origin"}, h.Values("Vary"))
+		assert.True(t, h.Has("VARY"))
+
+		h.Set("Vary", "*")
+		assert.Equal(t, Headers{
+			{Name: "Vary", Value: "*"},
+			{Name: "Content-Type", Value: "text/plain"},
+		}, h)
+
+		h.Set("X-New", "1")
+		assert.Equal(t, "X-New", h[len(h)-1].Name)
+
+		h.Del("vary")
+		assert.False(t, h.Has("Vary"))
+		assert.Equal(t, "", h.Get("Vary"))
+		assert.Nil(t, h.Values("Vary"))
+		assert.Len(t, h, 2)
+	})
+
+	t.Run("Clone is independent", func(t *testing.T) {
+		h := Headers{{Name: "A", Value: "1"}}
+		c := h.Clone()
+		c.Set("A", "2")
+		c.Add("B", "3")
+		assert.Equal(t, "1", h.Get("A"))
+		assert.False(t, h.Has("B"))
+	})
+}
+
+func TestHeadersValidation(t *testing.T) {
+	t.Run("Parse rejects bare CR, LF and NUL in values", func(t *testing.T) {
+		for _, line := range []string{
+			"X-Test: a\rInjected: 1\r\n",
+			"X-Test: a\nInjected: 1\r\n",
+			"X-Test: a\x00b\r\n",
+		} {
+			h := Headers{}
+			n, done, err := h.Parse([]byte(line))
+			require.ErrorIs(t, err, ErrInvalidFieldValue, "line %q", line)
+			assert.False(t, done)
+			assert.Equal(t, 0, n)
+			assert.Empty(t, h)
+		}
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		assert.NoError(t, Headers{{Name: "X-Ok", Value: "fine value\t1"}}.Validate())
+		assert.ErrorIs(t, Headers{{Name: "", Value: "v"}}.Validate(), ErrInvalidFieldName)
+		assert.ErrorIs(t, Headers{{Name: "Bad Name", Value: "v"}}.Validate(), ErrInvalidFieldName)
+		assert.ErrorIs(t, Headers{{Name: "X\r\nInjected", Value: "v"}}.Validate(), ErrInvalidFieldName)
+		assert.ErrorIs(t, Headers{{Name: "X-Test", Value: "v\r\nInjected: 1"}}.Validate(), ErrInvalidFieldValue)
+		assert.ErrorIs(t, Headers{{Name: "X-Test", Value: "v\x00"}}.Validate(), ErrInvalidFieldValue)
+	})
+}
+
+func TestHeadersTime(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", FormatTime(want.In(time.FixedZone("CET", 3600))))
+
+	for _, value := range []string{
+		"Sun, 06 Nov 1994 08:49:37 GMT",
+		"Sunday, 06-Nov-94 08:49:37 GMT",
+		"Sun Nov  6 08:49:37 1994",
+	} {
+		got, err := ParseTime(value)
+		require.NoError(t, err, value)
+		assert.True(t, want.Equal(got), value)
+	}
+
+	_, err := ParseTime("yesterday")
+	assert.Error(t, err)
+}
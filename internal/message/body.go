@@ -0,0 +1,91 @@
+package message
+
+import (
+	"fmt"
+	"io"
+)
+
+// Sink is the caller's buffer a body read fills. Parsers copy body bytes into
+// it and stop once it is full.
+type Sink struct {
+	dst []byte
+	n   int
+}
+
+// Space limits n to the room left in the buffer.
+func (s *Sink) Space(n int) int {
+	if space := len(s.dst) - s.n; n > space {
+		return space
+	}
+	return n
+}
+
+// Fill copies data, which must fit, into the buffer.
+func (s *Sink) Fill(data []byte) {
+	s.n += copy(s.dst[s.n:], data)
+}
+
+// Body streams a message body. Each read points the sink at the caller's
+// buffer and advances the parser until it has copied something or the
+// message is complete.
+type Body struct {
+	sink    *Sink
+	done    func() bool
+	advance func(done func() bool) error
+	closed  bool
+}
+
+// NewBody returns a body that advance parses into sink until done reports
+// that the message is complete.
+func NewBody(sink *Sink, done func() bool, advance func(done func() bool) error) *Body {
+	return &Body{sink: sink, done: done, advance: advance}
+}
+
+func (b *Body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, fmt.Errorf("read on closed body")
+	}
+	return b.read(p)
+}
+
+func (b *Body) Close() error {
+	b.closed = true
+	return nil
+}
+
+// Unclosed reads the body even after it was closed.
+func (b *Body) Unclosed() io.Reader {
+	return readerFunc(b.read)
+}
+
+func (b *Body) read(p []byte) (int, error) {
+	if b.done() {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	b.sink.dst = p
+	b.sink.n = 0
+	defer func() {
+		b.sink.dst = nil
+	}()
+
+	err := b.advance(func() bool {
+		return b.sink.n > 0 || b.done()
+	})
+	if b.sink.n > 0 {
+		return b.sink.n, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, io.EOF
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
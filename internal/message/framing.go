@@ -0,0 +1,109 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/glebson1988/httpfromtcp/internal/headers"
+)
+
+var (
+	ErrUnsupportedVersion                = errors.New("unsupported HTTP version")
+	ErrInvalidContentLength              = errors.New("invalid Content-Length")
+	ErrConflictingContentLength          = errors.New("conflicting Content-Length values")
+	ErrContentLengthWithTransferEncoding = errors.New("both Transfer-Encoding and Content-Length present")
+	ErrUnsupportedTransferEncoding       = errors.New("unsupported transfer coding")
+	ErrInvalidTransferEncoding           = errors.New("invalid Transfer-Encoding")
+)
+
+// BodyFraming decides how the message body is delimited following RFC 9112
+// section 6.3. It returns chunked=true for chunked bodies, otherwise the
+// declared Content-Length, which is 0 when the header is absent.
+func BodyFraming(h headers.Headers) (chunked bool, contentLength int64, err error) {
+	hasTransferEncoding := h.Has("transfer-encoding")
+	hasContentLength := h.Has("content-length")
+
+	if hasTransferEncoding {
+		if hasContentLength {
+			return false, 0, ErrContentLengthWithTransferEncoding
+		}
+		if err := validateTransferEncoding(h.Get("transfer-encoding")); err != nil {
+			return false, 0, err
+		}
+		return true, 0, nil
+	}
+	if !hasContentLength {
+		return false, 0, nil
+	}
+	contentLength, err = parseContentLength(h.Get("content-length"))
+	if err != nil {
+		return false, 0, err
+	}
+	return false, contentLength, nil
+}
+
+// validateTransferEncoding accepts only "chunked", the single transfer coding
+// the parsers can decode.
+func validateTransferEncoding(value string) error {
+	codings := strings.Split(value, ",")
+	for i, coding := range codings {
+		coding = strings.TrimSpace(coding)
+		if coding == "" {
+			return ErrInvalidTransferEncoding
+		}
+		if !strings.EqualFold(coding, "chunked") {
+			return ErrUnsupportedTransferEncoding
+		}
+		if i != len(codings)-1 {
+			return ErrInvalidTransferEncoding
+		}
+	}
+	return nil
+}
+
+// parseContentLength accepts a non-negative decimal, or a list of identical
+// ones produced by repeated Content-Length fields.
+func parseContentLength(value string) (int64, error) {
+	var contentLength int64 = -1
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return 0, ErrInvalidContentLength
+		}
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return 0, ErrInvalidContentLength
+		}
+		if contentLength != -1 && n != contentLength {
+			return 0, ErrConflictingContentLength
+		}
+		contentLength = n
+	}
+	return contentLength, nil
+}
+
+// ParseChunkSize parses a chunk size line, ignoring chunk extensions. It
+// returns the size and the bytes consumed including CRLF, or 0 consumed if
+// the line is not complete yet.
+func ParseChunkSize(data []byte) (int, int, error) {
+	lineEnd := bytes.Index(data, []byte("\r\n"))
+	if lineEnd == -1 {
+		if len(data) > maxChunkLineBytes {
+			return 0, 0, fmt.Errorf("chunk size line too long")
+		}
+		return 0, 0, nil
+	}
+	line := string(data[:lineEnd])
+	if extIndex := strings.IndexByte(line, ';'); extIndex != -1 {
+		line = line[:extIndex]
+	}
+	line = strings.TrimRight(line, " \t")
+	size, err := strconv.ParseUint(line, 16, 31)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid chunk size: %s", line)
+	}
+	return int(size), lineEnd + len("\r\n"), nil
+}
@@ -0,0 +1,19 @@
+package message
+
+// Limits bounds how much of a message a parser is willing to hold. A zero
+// field means no limit. MaxStartLineBytes bounds the request or status line,
+// and header limits cover trailer fields as well.
+type Limits struct {
+	MaxStartLineBytes int
+	MaxHeaderBytes    int
+	MaxHeaderCount    int
+	MaxBodyBytes      int64
+}
+
+var DefaultLimits = Limits{
+	MaxStartLineBytes: 8 << 10,
+	MaxHeaderBytes:    64 << 10,
+	MaxHeaderCount:    100,
+}
+
+const maxChunkLineBytes = 4 << 10
@@ -0,0 +1,68 @@
+// Package message holds the machinery requests and responses share:
+// buffering the connection, parser limits, body framing, keeping header
+// sections within their limits, and streaming and writing bodies.
+package message
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/glebson1988/httpfromtcp/internal/headers"
+)
+
+var (
+	ErrHeadersTooLarge = errors.New("header fields too large")
+	ErrTooManyHeaders  = errors.New("too many header fields")
+	ErrBodyTooLarge    = errors.New("message body too large")
+)
+
+// IsHTTPVersion reports whether version has the HTTP-version syntax
+// "HTTP/" DIGIT "." DIGIT.
+func IsHTTPVersion(version string) bool {
+	if len(version) != len("HTTP/1.1") || !strings.HasPrefix(version, "HTTP/") {
+		return false
+	}
+	major, dot, minor := version[5], version[6], version[7]
+	return major >= '0' && major <= '9' && dot == '.' && minor >= '0' && minor <= '9'
+}
+
+// Exceeds reports whether n is over limit, where a zero limit means none.
+func Exceeds(n, limit int) bool {
+	return limit > 0 && n > limit
+}
+
+// FieldParser parses the header and trailer lines of one message, keeping
+// their total size and count within MaxBytes and MaxCount. Zero limits mean
+// none.
+type FieldParser struct {
+	MaxBytes int
+	MaxCount int
+
+	bytes int
+	count int
+}
+
+// Parse parses one field line from data into h, like headers.Headers.Parse.
+func (p *FieldParser) Parse(h *headers.Headers, data []byte) (int, bool, error) {
+	consumed, done, err := h.Parse(data)
+	if err != nil {
+		return 0, false, err
+	}
+	if consumed == 0 {
+		if Exceeds(p.bytes+len(data), p.MaxBytes) {
+			return 0, false, ErrHeadersTooLarge
+		}
+		return 0, false, nil
+	}
+	p.bytes += consumed
+	if Exceeds(p.bytes, p.MaxBytes) {
+		return 0, false, ErrHeadersTooLarge
+	}
+	if !done {
+		p.count++
+		if Exceeds(p.count, p.MaxCount) {
+			return 0, false, ErrTooManyHeaders
+		}
+	}
+	return consumed, done, nil
+}
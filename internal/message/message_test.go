@@ -0,0 +1,152 @@
+package message
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/glebson1988/httpfromtcp/internal/headers"
+)
+
+func TestIsHTTPVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"HTTP/1.1", true},
+		{"HTTP/1.0", true},
+		{"HTTP/2.0", true},
+		{"HTTP/1", false},
+		{"HTTP/1.10", false},
+		{"http/1.1", false},
+		{"HTTP/a.1", false},
+		{"HTTP/1-1", false},
+	}
+	for _, tt := range tests {
+		if got := IsHTTPVersion(tt.version); got != tt.want {
+			t.Fatalf("IsHTTPVersion(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestFieldParser(t *testing.T) {
+	tests := []struct {
+		name    string
+		parser  FieldParser
+		data    string
+		wantErr error
+	}{
+		{name: "within limits", parser: FieldParser{MaxBytes: 64, MaxCount: 2}, data: "A: 1\r\nB: 2\r\n\r\n"},
+		{name: "no limits", data: "A: 1\r\nB: 2\r\nC: 3\r\n\r\n"},
+		{name: "too many fields", parser: FieldParser{MaxCount: 2}, data: "A: 1\r\nB: 2\r\nC: 3\r\n\r\n", wantErr: ErrTooManyHeaders},
+		{name: "too many bytes", parser: FieldParser{MaxBytes: 10}, data: "A: 1\r\nB: 2\r\n\r\n", wantErr: ErrHeadersTooLarge},
+		{name: "incomplete line over the limit", parser: FieldParser{MaxBytes: 10}, data: "A: 12345678901", wantErr: ErrHeadersTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := headers.Headers{}
+			data := []byte(tt.data)
+			var err error
+			for len(data) > 0 {
+				var n int
+				var done bool
+				n, done, err = tt.parser.Parse(&h, data)
+				if err != nil || n == 0 || done {
+					break
+				}
+				data = data[n:]
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	t.Run("limits cover every section", func(t *testing.T) {
+		p := FieldParser{MaxCount: 2}
+		h, trailers := headers.Headers{}, headers.Headers{}
+		for _, line := range []string{"A: 1\r\n", "\r\n"} {
+			if _, _, err := p.Parse(&h, []byte(line)); err != nil {
+				t.Fatalf("Parse returned error: %v", err)
+			}
+		}
+		if _, _, err := p.Parse(&trailers, []byte("B: 2\r\n")); err != nil {
+			t.Fatalf("Parse returned error: %v", err)
+		}
+		if _, _, err := p.Parse(&trailers, []byte("C: 3\r\n")); !errors.Is(err, ErrTooManyHeaders) {
+			t.Fatalf("expected ErrTooManyHeaders, got %v", err)
+		}
+	})
+}
+
+// lineParser is a minimal parser for the stream tests: each message is one
+// line, which it hands to the caller's sink as its body.
+type lineParser struct {
+	sink Sink
+	done bool
+}
+
+func (p *lineParser) parse(data []byte) (int, error) {
+	n := 0
+	for n < len(data) && !p.done {
+		if p.sink.Space(1) == 0 {
+			break
+		}
+		if data[n] == '\n' {
+			p.done = true
+		} else {
+			p.sink.Fill(data[n : n+1])
+		}
+		n++
+	}
+	return n, nil
+}
+
+func TestStreamBody(t *testing.T) {
+	stream := NewStream(iotest.OneByteReader(strings.NewReader("first\nsecond\n")), 2)
+	for _, want := range []string{"first", "second"} {
+		p := &lineParser{}
+		body := NewBody(&p.sink, func() bool { return p.done }, func(done func() bool) error {
+			return stream.Advance(p.parse, done)
+		})
+		got, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("ReadAll returned error: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("unexpected body: %q, want %q", got, want)
+		}
+	}
+	if stream.Buffered() != 0 {
+		t.Fatalf("unexpected bytes left: %d", stream.Buffered())
+	}
+
+	p := &lineParser{}
+	err := stream.Advance(p.parse, func() bool { return p.done })
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if !stream.Drained() {
+		t.Fatalf("expected the stream to be drained")
+	}
+}
+
+func TestBodyClose(t *testing.T) {
+	stream := NewStream(strings.NewReader("hello\n"), 8)
+	p := &lineParser{}
+	body := NewBody(&p.sink, func() bool { return p.done }, func(done func() bool) error {
+		return stream.Advance(p.parse, done)
+	})
+	if err := body.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if _, err := body.Read(make([]byte, 4)); err == nil {
+		t.Fatalf("expected an error reading a closed body")
+	}
+	got, err := io.ReadAll(body.Unclosed())
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("unexpected unclosed read: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,70 @@
+package message
+
+import (
+	"fmt"
+	"io"
+)
+
+// Stream buffers a connection for a parser. Bytes read past the end of one
+// message stay buffered for the next.
+type Stream struct {
+	reader   io.Reader
+	buf      []byte
+	buffered int
+	eof      bool
+}
+
+// NewStream reads from reader into a buffer that starts at size bytes and
+// grows as messages need.
+func NewStream(reader io.Reader, size int) *Stream {
+	return &Stream{reader: reader, buf: make([]byte, size)}
+}
+
+// Buffered returns the number of bytes read but not consumed yet.
+func (s *Stream) Buffered() int {
+	return s.buffered
+}
+
+// Drained reports whether the reader is exhausted and every byte consumed.
+func (s *Stream) Drained() bool {
+	return s.eof && s.buffered == 0
+}
+
+// Advance feeds buffered and newly read bytes to parse until done reports
+// true. It returns io.ErrUnexpectedEOF if the reader ends first.
+func (s *Stream) Advance(parse func(data []byte) (int, error), done func() bool) error {
+	for {
+		if s.buffered > 0 {
+			consumed, err := parse(s.buf[:s.buffered])
+			if err != nil {
+				return err
+			}
+			if consumed > 0 {
+				copy(s.buf, s.buf[consumed:s.buffered])
+				s.buffered -= consumed
+			}
+		}
+		if done() {
+			return nil
+		}
+
+		if s.eof {
+			return io.ErrUnexpectedEOF
+		}
+
+		if s.buffered == len(s.buf) {
+			newBuf := make([]byte, len(s.buf)*2)
+			copy(newBuf, s.buf[:s.buffered])
+			s.buf = newBuf
+		}
+
+		n, err := s.reader.Read(s.buf[s.buffered:])
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read from reader: %w", err)
+		}
+		s.buffered += n
+		if err == io.EOF {
+			s.eof = true
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/glebson1988/httpfromtcp/internal/headers"
+)
+
+const writeChunkSize = 32 << 10
+
+// WriteBody copies body to w framed the way the header section h declares it:
+// chunked followed by trailers, exactly Content-Length bytes, or everything
+// up to the end of body when h declares neither. trailers is read once body
+// is exhausted, so trailers of a body streamed from a parsed message are
+// passed on too.
+func WriteBody(w io.Writer, h headers.Headers, body io.Reader, trailers *headers.Headers) error {
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	chunked, contentLength, err := BodyFraming(h)
+	if err != nil {
+		return err
+	}
+	if chunked {
+		return writeChunked(w, body, trailers)
+	}
+	if !h.Has("content-length") {
+		_, err := io.Copy(w, body)
+		return err
+	}
+
+	n, err := io.CopyN(w, body, contentLength)
+	if err == io.EOF {
+		return fmt.Errorf("body is %d bytes, Content-Length is %d", n, contentLength)
+	}
+	if err != nil {
+		return err
+	}
+	var extra [1]byte
+	if n, _ := body.Read(extra[:]); n > 0 {
+		return fmt.Errorf("body is longer than Content-Length %d", contentLength)
+	}
+	return nil
+}
+
+func writeChunked(w io.Writer, body io.Reader, trailers *headers.Headers) error {
+	buf := make([]byte, writeChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := fmt.Fprintf(w, "%x\r\n", n); err != nil {
+				return err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, "\r\n"); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(w, "0\r\n"); err != nil {
+		return err
+	}
+	if trailers == nil {
+		return headers.Headers(nil).Write(w)
+	}
+	return trailers.Write(w)
+}
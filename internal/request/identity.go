@@ -0,0 +1,40 @@
+package request
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+)
+
+// PeerIdentity is the identity a client proved with a verified certificate.
+type PeerIdentity struct {
+	// Subject is the certificate's distinguished name, such as
+	// "CN=billing,O=Example".
+	Subject    string
+	CommonName string
+	// The subject alternative names, by type.
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []string
+	// Fingerprint is the hex SHA-256 of the certificate's DER encoding.
+	Fingerprint string
+}
+
+// NewPeerIdentity describes the identity in cert.
+func NewPeerIdentity(cert *x509.Certificate) *PeerIdentity {
+	sum := sha256.Sum256(cert.Raw)
+	id := &PeerIdentity{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		Fingerprint:    hex.EncodeToString(sum[:]),
+	}
+	for _, uri := range cert.URIs {
+		id.URIs = append(id.URIs, uri.String())
+	}
+	return id
+}
@@ -0,0 +1,27 @@
+package request
+
+import (
+	"errors"
+
+	"github.com/glebson1988/httpfromtcp/internal/message"
+)
+
+var (
+	ErrRequestLineTooLong = errors.New("request line too long")
+	ErrHeadersTooLarge    = message.ErrHeadersTooLarge
+	ErrTooManyHeaders     = message.ErrTooManyHeaders
+	ErrBodyTooLarge       = message.ErrBodyTooLarge
+
+	ErrUnsupportedVersion                = message.ErrUnsupportedVersion
+	ErrInvalidContentLength              = message.ErrInvalidContentLength
+	ErrConflictingContentLength          = message.ErrConflictingContentLength
+	ErrContentLengthWithTransferEncoding = message.ErrContentLengthWithTransferEncoding
+	ErrUnsupportedTransferEncoding       = message.ErrUnsupportedTransferEncoding
+	ErrInvalidTransferEncoding           = message.ErrInvalidTransferEncoding
+)
+
+// Limits bounds how much of a request the parser is willing to hold, with
+// MaxStartLineBytes bounding the request line.
+type Limits = message.Limits
+
+var DefaultLimits = message.DefaultLimits
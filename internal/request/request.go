@@ -2,23 +2,48 @@ package request
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"net/url"
 	"strings"
 
 	"github.com/glebson1988/httpfromtcp/internal/headers"
+	"github.com/glebson1988/httpfromtcp/internal/message"
 )
 
 type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
-	state       parserState
-	Body        []byte
+	Trailers    headers.Headers
+	// BodyReader streams the message body as it arrives on the connection.
+	BodyReader io.ReadCloser
+	// Body holds the whole body once ReadBody has been called.
+	Body []byte
+	// TLS describes the connection the request arrived on, with the
+	// negotiated version, cipher suite and peer certificates. It is nil for
+	// plaintext connections.
+	TLS *tls.ConnectionState
+	// Peer is the client's identity when it presented a certificate that
+	// verified against the server's client CAs, and nil otherwise.
+	Peer *PeerIdentity
+	// PathValues holds the path parameters a router matched, by name.
+	PathValues map[string]string
+	state      parserState
+
+	limits         Limits
+	fields         message.FieldParser
+	bodyRemaining  int64
+	chunkedTotal   int64
+	chunkRemaining int
+	sink           message.Sink
+	body           *message.Body
 }
 
 type RequestLine struct {
 	HttpVersion   string
 	RequestTarget string
+	Target        Target
 	Method        string
 }
 
@@ -28,53 +53,157 @@ const (
 	requestStateInitialized parserState = iota
 	requestStateParsingHeaders
 	requestStateParsingBody
+	requestStateParsingChunkSize
+	requestStateParsingChunkData
+	requestStateParsingChunkEnd
+	requestStateParsingTrailers
 	requestStateDone
 )
 
-const bufferSize = 8
+// bufferSize is where the read buffer starts. Body bytes pass through it on
+// their way to BodyReader, so it is also the largest read a body makes.
+const bufferSize = 4 << 10
+
+type Reader struct {
+	Limits Limits
+
+	stream  *message.Stream
+	current *Request
+}
 
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		Limits: DefaultLimits,
+		stream: message.NewStream(reader, bufferSize),
+	}
+}
+
+// RequestFromReader parses a single request and buffers its whole body into
+// Body. Use a Reader to stream bodies instead.
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize, bufferSize)
-	readToIndex := 0
-	req := &Request{state: requestStateInitialized}
-
-	for req.state != requestStateDone {
-		if readToIndex == len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf[:readToIndex])
-			buf = newBuf
-		}
-
-		n, err := reader.Read(buf[readToIndex:])
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("failed to read from reader: %w", err)
-		}
-		if n > 0 {
-			readToIndex += n
-			consumed, parseErr := req.parse(buf[:readToIndex])
-			if parseErr != nil {
-				return nil, parseErr
-			}
-			if consumed > 0 {
-				copy(buf, buf[consumed:readToIndex])
-				readToIndex -= consumed
-			}
-		}
+	req, err := NewReader(reader).ReadRequest()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := req.ReadBody(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
 
-		if err == io.EOF {
-			if req.state != requestStateDone {
-				return nil, fmt.Errorf("unexpected EOF")
-			}
-			break
-		}
+// ReadRequest parses the next request line and headers from the underlying
+// reader and returns as soon as the headers are complete. The body is read
+// lazily through BodyReader and must be consumed or discarded before the next
+// call. Bytes read past the end of a request are kept, so pipelined requests
+// on one connection are returned in order. It returns io.EOF if the reader is
+// exhausted before any byte of a new request arrives.
+func (r *Reader) ReadRequest() (*Request, error) {
+	if r.current != nil && r.current.state != requestStateDone {
+		return nil, fmt.Errorf("previous request body was not fully read")
+	}
+
+	req := &Request{
+		state:  requestStateInitialized,
+		limits: r.Limits,
+		fields: message.FieldParser{MaxBytes: r.Limits.MaxHeaderBytes, MaxCount: r.Limits.MaxHeaderCount},
+	}
+	err := r.stream.Advance(req.parse, req.headersDone)
+	if err == io.ErrUnexpectedEOF && req.state == requestStateInitialized && r.stream.Buffered() == 0 {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	if req.RequestLine.Method == "" {
 		return nil, fmt.Errorf("failed to parse request line")
 	}
+	req.body = message.NewBody(&req.sink, req.done, func(done func() bool) error {
+		return r.stream.Advance(req.parse, done)
+	})
+	req.BodyReader = req.body
+	r.current = req
 	return req, nil
 }
 
+// ReadBody reads the rest of the body into Body and returns it.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.BodyReader == nil {
+		return r.Body, nil
+	}
+	data, err := io.ReadAll(r.BodyReader)
+	r.Body = append(r.Body, data...)
+	if err != nil {
+		return r.Body, err
+	}
+	return r.Body, nil
+}
+
+// DiscardBody reads and drops whatever is left of the body, so the
+// connection can carry the next request. It gives up once more than limit
+// bytes remain.
+func (r *Request) DiscardBody(limit int64) error {
+	if r.body == nil {
+		return nil
+	}
+	n, err := io.CopyN(io.Discard, r.body.Unclosed(), limit+1)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		return fmt.Errorf("unread body exceeds %d bytes", limit)
+	}
+	return nil
+}
+
+// BodyPending reports whether part of the body is still to be read. It is
+// false from the start for a request without a body.
+func (r *Request) BodyPending() bool {
+	return !r.done()
+}
+
+// KeepAlive reports whether the client allows the connection to be reused
+// after this request. HTTP/1.1 connections persist unless "Connection: close"
+// is sent, HTTP/1.0 ones only with "Connection: keep-alive". An HTTP/1.0
+// request with Transfer-Encoding has faulty framing (RFC 9112 section 6.1),
+// so its connection never persists.
+func (r *Request) KeepAlive() bool {
+	if r.Headers.HasToken("connection", "close") {
+		return false
+	}
+	if r.RequestLine.HttpVersion == "1.0" {
+		return !r.Headers.Has("transfer-encoding") && r.Headers.HasToken("connection", "keep-alive")
+	}
+	return true
+}
+
+// Path returns the percent-decoded path of the request target.
+func (r *Request) Path() string {
+	return r.RequestLine.Target.Path
+}
+
+// PathValue returns the path parameter called name, or "" if the route that
+// matched the request has none by that name.
+func (r *Request) PathValue(name string) string {
+	return r.PathValues[name]
+}
+
+// Query returns the parameters of the request target's query string.
+func (r *Request) Query() url.Values {
+	return r.RequestLine.Target.Query()
+}
+
+func (r *Request) headersDone() bool {
+	return r.state > requestStateParsingHeaders
+}
+
+func (r *Request) done() bool {
+	return r.state == requestStateDone
+}
+
 func parseRequestLine(data []byte) (RequestLine, int, error) {
 	lineEnd := bytes.Index(data, []byte("\r\n"))
 	if lineEnd == -1 {
@@ -94,13 +223,21 @@ func parseRequestLine(data []byte) (RequestLine, int, error) {
 			return RequestLine{}, 0, fmt.Errorf("invalid HTTP method: %s", method)
 		}
 	}
-	if version != "HTTP/1.1" {
+	if !message.IsHTTPVersion(version) {
 		return RequestLine{}, 0, fmt.Errorf("invalid HTTP version: %s", version)
 	}
+	if version[len("HTTP/")] != '1' {
+		return RequestLine{}, 0, fmt.Errorf("%w: %s", ErrUnsupportedVersion, version)
+	}
+	parsedTarget, err := parseTarget(method, target)
+	if err != nil {
+		return RequestLine{}, 0, fmt.Errorf("%w: %s", err, target)
+	}
 	httpVersion := strings.TrimPrefix(version, "HTTP/")
 	return RequestLine{
 		Method:        method,
 		RequestTarget: target,
+		Target:        parsedTarget,
 		HttpVersion:   httpVersion,
 	}, lineEnd + len("\r\n"), nil
 }
@@ -128,8 +265,14 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return 0, err
 		}
 		if consumed == 0 {
+			if message.Exceeds(len(data), r.limits.MaxStartLineBytes) {
+				return 0, ErrRequestLineTooLong
+			}
 			return 0, nil
 		}
+		if message.Exceeds(consumed-len("\r\n"), r.limits.MaxStartLineBytes) {
+			return 0, ErrRequestLineTooLong
+		}
 		r.RequestLine = reqLine
 		r.state = requestStateParsingHeaders
 		return consumed, nil
@@ -137,7 +280,7 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if r.Headers == nil {
 			r.Headers = headers.Headers{}
 		}
-		consumed, done, err := r.Headers.Parse(data)
+		consumed, done, err := r.fields.Parse(&r.Headers, data)
 		if err != nil {
 			return 0, err
 		}
@@ -145,37 +288,98 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return 0, nil
 		}
 		if done {
-			r.state = requestStateParsingBody
+			if err := r.startBody(); err != nil {
+				return 0, err
+			}
 		}
 		return consumed, nil
 	case requestStateParsingBody:
-		contentLengthStr := r.Headers.Get("content-length")
-		if contentLengthStr == "" {
+		toRead := r.sink.Space(len(data))
+		if int64(toRead) > r.bodyRemaining {
+			toRead = int(r.bodyRemaining)
+		}
+		r.sink.Fill(data[:toRead])
+		r.bodyRemaining -= int64(toRead)
+		if r.bodyRemaining == 0 {
 			r.state = requestStateDone
-			return len(data), nil
 		}
-
-		var contentLength int
-		_, err := fmt.Sscanf(contentLengthStr, "%d", &contentLength)
+		return toRead, nil
+	case requestStateParsingChunkSize:
+		size, consumed, err := message.ParseChunkSize(data)
 		if err != nil {
-			return 0, fmt.Errorf("invalid Content-Length: %s", contentLengthStr)
+			return 0, err
 		}
-
-		toRead := len(data)
-		remaining := contentLength - len(r.Body)
-		if toRead > remaining {
-			toRead = remaining
+		if consumed == 0 {
+			return 0, nil
 		}
-
-		r.Body = append(r.Body, data[:toRead]...)
-
-		if len(r.Body) == contentLength {
-			r.state = requestStateDone
+		r.chunkedTotal += int64(size)
+		if r.limits.MaxBodyBytes > 0 && r.chunkedTotal > r.limits.MaxBodyBytes {
+			return 0, ErrBodyTooLarge
+		}
+		if size == 0 {
+			r.Trailers = headers.Headers{}
+			r.state = requestStateParsingTrailers
+		} else {
+			r.chunkRemaining = size
+			r.state = requestStateParsingChunkData
+		}
+		return consumed, nil
+	case requestStateParsingChunkData:
+		toRead := r.sink.Space(len(data))
+		if toRead > r.chunkRemaining {
+			toRead = r.chunkRemaining
+		}
+		r.sink.Fill(data[:toRead])
+		r.chunkRemaining -= toRead
+		if r.chunkRemaining == 0 {
+			r.state = requestStateParsingChunkEnd
 		}
 		return toRead, nil
+	case requestStateParsingChunkEnd:
+		if len(data) < len("\r\n") {
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, []byte("\r\n")) {
+			return 0, fmt.Errorf("missing CRLF after chunk data")
+		}
+		r.state = requestStateParsingChunkSize
+		return len("\r\n"), nil
+	case requestStateParsingTrailers:
+		consumed, done, err := r.fields.Parse(&r.Trailers, data)
+		if err != nil {
+			return 0, err
+		}
+		if consumed == 0 {
+			return 0, nil
+		}
+		if done {
+			r.state = requestStateDone
+		}
+		return consumed, nil
 	case requestStateDone:
 		return 0, fmt.Errorf("error: trying to read data in a done state")
 	default:
 		return 0, fmt.Errorf("error: unknown state")
 	}
 }
+
+func (r *Request) startBody() error {
+	chunked, contentLength, err := message.BodyFraming(r.Headers)
+	if err != nil {
+		return err
+	}
+	if chunked {
+		r.state = requestStateParsingChunkSize
+		return nil
+	}
+	if contentLength == 0 {
+		r.state = requestStateDone
+		return nil
+	}
+	if r.limits.MaxBodyBytes > 0 && contentLength > r.limits.MaxBodyBytes {
+		return ErrBodyTooLarge
+	}
+	r.bodyRemaining = contentLength
+	r.state = requestStateParsingBody
+	return nil
+}
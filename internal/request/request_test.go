@@ -2,8 +2,10 @@ package request
 
 import (
 	"io"
+	"strings"
 	"testing"
 
+	"github.com/glebson1988/httpfromtcp/internal/headers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -30,6 +32,12 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
 func TestRequestFromReader(t *testing.T) {
 	t.Run("Good request line", func(t *testing.T) {
 		reader := &chunkReader{
@@ -101,21 +109,32 @@ func TestRequestFromReader(t *testing.T) {
 			numBytesPerRead: 2,
 		}
 		_, err := RequestFromReader(reader)
-		require.Error(t, err)
+		require.ErrorIs(t, err, ErrUnsupportedVersion)
 		reader = &chunkReader{
-			data:            "GET / HTTP/1.0\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
+			data:            "GET / HTTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
 			numBytesPerRead: 2,
 		}
 		_, err = RequestFromReader(reader)
 		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrUnsupportedVersion)
 		reader = &chunkReader{
-			data:            "GET / HTTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
+			data:            "GET / HTTP/1.1.1\r\nHost: localhost:42069\r\n\r\n",
 			numBytesPerRead: 2,
 		}
 		_, err = RequestFromReader(reader)
 		require.Error(t, err)
 	})
 
+	t.Run("HTTP/1.0 request line", func(t *testing.T) {
+		reader := &chunkReader{
+			data:            "GET / HTTP/1.0\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
+			numBytesPerRead: 2,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	})
+
 	t.Run("Missing request line", func(t *testing.T) {
 		reader := &chunkReader{
 			data:            "\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
@@ -153,9 +172,9 @@ func TestRequestParseHeaders(t *testing.T) {
 		r, err := RequestFromReader(reader)
 		require.NoError(t, err)
 		require.NotNil(t, r)
-		assert.Equal(t, "localhost:42069", r.Headers["host"])
-		assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-		assert.Equal(t, "*/*", r.Headers["accept"])
+		assert.Equal(t, "localhost:42069", r.Headers.Get("host"))
+		assert.Equal(t, "curl/7.81.0", r.Headers.Get("user-agent"))
+		assert.Equal(t, "*/*", r.Headers.Get("accept"))
 	})
 
 	t.Run("Empty Headers", func(t *testing.T) {
@@ -186,7 +205,7 @@ func TestRequestParseHeaders(t *testing.T) {
 		r, err := RequestFromReader(reader)
 		require.NoError(t, err)
 		require.NotNil(t, r)
-		assert.Equal(t, "lane-loves-go, prime-loves-zig, tj-loves-ocaml", r.Headers["set-person"])
+		assert.Equal(t, "lane-loves-go, prime-loves-zig, tj-loves-ocaml", r.Headers.Get("set-person"))
 	})
 
 	t.Run("Case Insensitive Headers", func(t *testing.T) {
@@ -197,8 +216,8 @@ func TestRequestParseHeaders(t *testing.T) {
 		r, err := RequestFromReader(reader)
 		require.NoError(t, err)
 		require.NotNil(t, r)
-		assert.Equal(t, "localhost:42069", r.Headers["host"])
-		assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
+		assert.Equal(t, "localhost:42069", r.Headers.Get("host"))
+		assert.Equal(t, "curl/7.81.0", r.Headers.Get("user-agent"))
 	})
 
 	t.Run("Missing End of Headers", func(t *testing.T) {
@@ -279,3 +298,689 @@ func TestRequestParseHeaders(t *testing.T) {
 		assert.Equal(t, "", string(r.Body))
 	})
 }
+
+func TestRequestChunkedBody(t *testing.T) {
+	t.Run("Chunked body", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /upload HTTP/1.1\r\n" +
+				"Host: localhost:42069\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"5\r\nhello\r\n" +
+				"7\r\n, world\r\n" +
+				"0\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		require.NotNil(t, r)
+		assert.Equal(t, "hello, world", string(r.Body))
+		assert.Empty(t, r.Trailers)
+	})
+
+	t.Run("Chunked body with extensions and trailers", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /upload HTTP/1.1\r\n" +
+				"Host: localhost:42069\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"Trailer: X-Checksum\r\n" +
+				"\r\n" +
+				"A;name=value\r\n0123456789\r\n" +
+				"0;last\r\n" +
+				"X-Checksum: abc123\r\n" +
+				"\r\n",
+			numBytesPerRead: 4,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		require.NotNil(t, r)
+		assert.Equal(t, "0123456789", string(r.Body))
+		assert.Equal(t, "abc123", r.Trailers.Get("x-checksum"))
+	})
+
+	t.Run("Invalid chunk size", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /upload HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"zz\r\nhello\r\n" +
+				"0\r\n\r\n",
+			numBytesPerRead: 5,
+		}
+		_, err := RequestFromReader(reader)
+		require.Error(t, err)
+	})
+
+	t.Run("Chunk data longer than chunk size", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /upload HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"3\r\nhello\r\n" +
+				"0\r\n\r\n",
+			numBytesPerRead: 5,
+		}
+		_, err := RequestFromReader(reader)
+		require.Error(t, err)
+	})
+
+	t.Run("Missing last chunk", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /upload HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"5\r\nhello\r\n",
+			numBytesPerRead: 5,
+		}
+		_, err := RequestFromReader(reader)
+		require.Error(t, err)
+	})
+}
+
+func TestReaderPipelinedRequests(t *testing.T) {
+	t.Run("Keeps bytes of the next request", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data: "POST /first HTTP/1.1\r\n" +
+				"Content-Length: 5\r\n" +
+				"\r\n" +
+				"hello" +
+				"GET /second HTTP/1.1\r\n" +
+				"Host: localhost:42069\r\n" +
+				"\r\n" +
+				"PUT /third HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"3\r\nabc\r\n0\r\n\r\n",
+			numBytesPerRead: 64,
+		})
+
+		r, err := reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+		body, err := io.ReadAll(r.BodyReader)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(body))
+
+		r, err = reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+		body, err = io.ReadAll(r.BodyReader)
+		require.NoError(t, err)
+		assert.Equal(t, "", string(body))
+
+		r, err = reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "/third", r.RequestLine.RequestTarget)
+		body, err = r.ReadBody()
+		require.NoError(t, err)
+		assert.Equal(t, "abc", string(body))
+
+		_, err = reader.ReadRequest()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Truncated request after a complete one", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data:            "GET / HTTP/1.1\r\n\r\nGET / HT",
+			numBytesPerRead: 7,
+		})
+
+		_, err := reader.ReadRequest()
+		require.NoError(t, err)
+		_, err = reader.ReadRequest()
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestReaderStreamingBody(t *testing.T) {
+	t.Run("Returns before the body arrives", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		go func() {
+			_, _ = io.WriteString(pw, "POST /upload HTTP/1.1\r\nContent-Length: 11\r\n\r\n")
+		}()
+
+		r, err := NewReader(pr).ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "/upload", r.RequestLine.RequestTarget)
+		assert.Nil(t, r.Body)
+
+		go func() {
+			_, _ = io.WriteString(pw, "hello ")
+			_, _ = io.WriteString(pw, "world")
+		}()
+		body, err := r.ReadBody()
+		require.NoError(t, err)
+		assert.Equal(t, "hello world", string(body))
+	})
+
+	t.Run("Reads chunked body in small pieces", func(t *testing.T) {
+		r, err := NewReader(&chunkReader{
+			data: "POST /upload HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"A\r\n0123456789\r\n" +
+				"0\r\n" +
+				"X-Checksum: abc123\r\n" +
+				"\r\n",
+			numBytesPerRead: 6,
+		}).ReadRequest()
+		require.NoError(t, err)
+
+		var got []byte
+		p := make([]byte, 3)
+		for {
+			n, err := r.BodyReader.Read(p)
+			assert.LessOrEqual(t, n, len(p))
+			got = append(got, p[:n]...)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+		}
+		assert.Equal(t, "0123456789", string(got))
+		assert.Equal(t, "abc123", r.Trailers.Get("x-checksum"))
+	})
+
+	t.Run("Reads a large body in large pieces", func(t *testing.T) {
+		const size = 1 << 20
+		reads := 0
+		src := &chunkReader{
+			data:            "POST /upload HTTP/1.1\r\nContent-Length: 1048576\r\n\r\n" + strings.Repeat("a", size),
+			numBytesPerRead: size,
+		}
+		r, err := NewReader(readerFunc(func(p []byte) (int, error) {
+			reads++
+			return src.Read(p)
+		})).ReadRequest()
+		require.NoError(t, err)
+		n, err := io.Copy(io.Discard, r.BodyReader)
+		require.NoError(t, err)
+		assert.Equal(t, int64(size), n)
+		assert.LessOrEqual(t, reads, size/(4<<10)+2)
+	})
+
+	t.Run("Truncated body", func(t *testing.T) {
+		r, err := NewReader(&chunkReader{
+			data:            "POST /upload HTTP/1.1\r\nContent-Length: 10\r\n\r\nshort",
+			numBytesPerRead: 4,
+		}).ReadRequest()
+		require.NoError(t, err)
+		_, err = io.ReadAll(r.BodyReader)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("Next request requires the body to be consumed", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data: "POST /a HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc" +
+				"GET /b HTTP/1.1\r\n\r\n",
+			numBytesPerRead: 5,
+		})
+		r, err := reader.ReadRequest()
+		require.NoError(t, err)
+		require.NoError(t, r.BodyReader.Close())
+
+		_, err = reader.ReadRequest()
+		require.Error(t, err)
+
+		require.NoError(t, r.DiscardBody(1024))
+		r, err = reader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+	})
+
+	t.Run("DiscardBody gives up past the limit", func(t *testing.T) {
+		r, err := NewReader(&chunkReader{
+			data:            "POST /a HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789",
+			numBytesPerRead: 5,
+		}).ReadRequest()
+		require.NoError(t, err)
+		require.Error(t, r.DiscardBody(4))
+	})
+}
+
+func TestReaderLimits(t *testing.T) {
+	limits := Limits{
+		MaxStartLineBytes: 32,
+		MaxHeaderBytes:    64,
+		MaxHeaderCount:    3,
+		MaxBodyBytes:      8,
+	}
+	tests := []struct {
+		name    string
+		data    string
+		wantErr error
+	}{
+		{
+			name:    "Request line too long",
+			data:    "GET /" + strings.Repeat("a", 40) + " HTTP/1.1\r\n\r\n",
+			wantErr: ErrRequestLineTooLong,
+		},
+		{
+			name:    "Request line without CRLF too long",
+			data:    "GET /" + strings.Repeat("a", 40),
+			wantErr: ErrRequestLineTooLong,
+		},
+		{
+			name:    "Header bytes too large",
+			data:    "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("b", 64) + "\r\n\r\n",
+			wantErr: ErrHeadersTooLarge,
+		},
+		{
+			name:    "Too many headers",
+			data:    "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n",
+			wantErr: ErrTooManyHeaders,
+		},
+		{
+			name:    "Content-Length over body limit",
+			data:    "POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n123456789",
+			wantErr: ErrBodyTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewReader(&chunkReader{data: tt.data, numBytesPerRead: 7})
+			reader.Limits = limits
+			_, err := reader.ReadRequest()
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	t.Run("Chunked body over body limit", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n",
+			numBytesPerRead: 7,
+		})
+		reader.Limits = limits
+		r, err := reader.ReadRequest()
+		require.NoError(t, err)
+		_, err = io.ReadAll(r.BodyReader)
+		assert.ErrorIs(t, err, ErrBodyTooLarge)
+	})
+
+	t.Run("Trailers count against header limits", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nA: 1\r\n\r\n" +
+				"0\r\nB: 2\r\nC: 3\r\n\r\n",
+			numBytesPerRead: 7,
+		})
+		reader.Limits = limits
+		r, err := reader.ReadRequest()
+		require.NoError(t, err)
+		_, err = io.ReadAll(r.BodyReader)
+		assert.ErrorIs(t, err, ErrTooManyHeaders)
+	})
+
+	t.Run("Requests within limits", func(t *testing.T) {
+		reader := NewReader(&chunkReader{
+			data:            "POST /ok HTTP/1.1\r\nHost: a\r\nContent-Length: 8\r\n\r\n12345678",
+			numBytesPerRead: 7,
+		})
+		reader.Limits = limits
+		r, err := reader.ReadRequest()
+		require.NoError(t, err)
+		body, err := r.ReadBody()
+		require.NoError(t, err)
+		assert.Equal(t, "12345678", string(body))
+	})
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+		wantErr error
+	}{
+		{
+			name:    "Conflicting duplicate Content-Length",
+			headers: "Content-Length: 5\r\nContent-Length: 10\r\n",
+			wantErr: ErrConflictingContentLength,
+		},
+		{
+			name:    "Conflicting Content-Length list",
+			headers: "Content-Length: 5, 6\r\n",
+			wantErr: ErrConflictingContentLength,
+		},
+		{
+			name:    "Negative Content-Length",
+			headers: "Content-Length: -3\r\n",
+			wantErr: ErrInvalidContentLength,
+		},
+		{
+			name:    "Content-Length with trailing garbage",
+			headers: "Content-Length: 12abc\r\n",
+			wantErr: ErrInvalidContentLength,
+		},
+		{
+			name:    "Content-Length with plus sign",
+			headers: "Content-Length: +5\r\n",
+			wantErr: ErrInvalidContentLength,
+		},
+		{
+			name:    "Empty Content-Length",
+			headers: "Content-Length: \r\n",
+			wantErr: ErrInvalidContentLength,
+		},
+		{
+			name:    "Content-Length overflow",
+			headers: "Content-Length: 99999999999999999999\r\n",
+			wantErr: ErrInvalidContentLength,
+		},
+		{
+			name:    "Transfer-Encoding and Content-Length",
+			headers: "Content-Length: 5\r\nTransfer-Encoding: chunked\r\n",
+			wantErr: ErrContentLengthWithTransferEncoding,
+		},
+		{
+			name:    "Unknown transfer coding",
+			headers: "Transfer-Encoding: gzip, chunked\r\n",
+			wantErr: ErrUnsupportedTransferEncoding,
+		},
+		{
+			name:    "Misspelled chunked",
+			headers: "Transfer-Encoding: chunkd\r\n",
+			wantErr: ErrUnsupportedTransferEncoding,
+		},
+		{
+			name:    "Chunked applied twice",
+			headers: "Transfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n",
+			wantErr: ErrInvalidTransferEncoding,
+		},
+		{
+			name:    "Empty Transfer-Encoding",
+			headers: "Transfer-Encoding: \r\n",
+			wantErr: ErrInvalidTransferEncoding,
+		},
+		{
+			name:    "Whitespace before colon",
+			headers: "Content-Length : 5\r\n",
+			wantErr: headers.ErrWhitespaceBeforeColon,
+		},
+		{
+			name:    "Tab before colon",
+			headers: "Transfer-Encoding\t: chunked\r\n",
+			wantErr: headers.ErrWhitespaceBeforeColon,
+		},
+		{
+			name:    "Obsolete line folding",
+			headers: "X-A: 1\r\n Transfer-Encoding: chunked\r\n",
+			wantErr: headers.ErrObsFold,
+		},
+		{
+			name:    "Whitespace after start line",
+			headers: "\tTransfer-Encoding: chunked\r\n",
+			wantErr: headers.ErrObsFold,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := &chunkReader{
+				data:            "POST / HTTP/1.1\r\n" + tt.headers + "Host: localhost:42069\r\n\r\nhello",
+				numBytesPerRead: 4,
+			}
+			_, err := RequestFromReader(reader)
+			require.ErrorIs(t, err, tt.wantErr)
+			for _, other := range tests {
+				if other.wantErr != tt.wantErr {
+					assert.NotErrorIs(t, err, other.wantErr)
+				}
+			}
+		})
+	}
+
+	t.Run("Identical duplicate Content-Length", func(t *testing.T) {
+		reader := &chunkReader{
+			data:            "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+			numBytesPerRead: 4,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(r.Body))
+	})
+
+	t.Run("Chunked is case insensitive", func(t *testing.T) {
+		reader := &chunkReader{
+			data:            "POST / HTTP/1.1\r\nTransfer-Encoding: Chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			numBytesPerRead: 4,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(r.Body))
+	})
+}
+
+func TestRequestTarget(t *testing.T) {
+	t.Run("Origin form with query", func(t *testing.T) {
+		reader := &chunkReader{
+			data:            "GET /files/my%20doc.txt?x=1&tag=a&tag=b%26c HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+			numBytesPerRead: 5,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		target := r.RequestLine.Target
+		assert.Equal(t, OriginForm, target.Form)
+		assert.Equal(t, "/files/my doc.txt", target.Path)
+		assert.Equal(t, "/files/my%20doc.txt", target.RawPath)
+		assert.Equal(t, "x=1&tag=a&tag=b%26c", target.RawQuery)
+		assert.Equal(t, "/files/my doc.txt", r.Path())
+		assert.Equal(t, "1", r.Query().Get("x"))
+		assert.Equal(t, []string{"a", "b&c"}, r.Query()["tag"])
+		assert.Equal(t, "", r.Query().Get("missing"))
+	})
+
+	t.Run("Absolute form", func(t *testing.T) {
+		reader := &chunkReader{
+			data:            "GET HTTP://example.com:8080/a%2Fb?q=go HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			numBytesPerRead: 5,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		target := r.RequestLine.Target
+		assert.Equal(t, AbsoluteForm, target.Form)
+		assert.Equal(t, "http", target.Scheme)
+		assert.Equal(t, "example.com:8080", target.Host)
+		assert.Equal(t, "/a/b", target.Path)
+		assert.Equal(t, "/a%2Fb", target.RawPath)
+		assert.Equal(t, "go", r.Query().Get("q"))
+	})
+
+	t.Run("Absolute form without path", func(t *testing.T) {
+		reader := &chunkReader{
+			data:            "GET http://example.com HTTP/1.1\r\n\r\n",
+			numBytesPerRead: 5,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "/", r.Path())
+	})
+
+	t.Run("Authority form", func(t *testing.T) {
+		reader := &chunkReader{
+			data:            "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			numBytesPerRead: 5,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, AuthorityForm, r.RequestLine.Target.Form)
+		assert.Equal(t, "example.com:443", r.RequestLine.Target.Host)
+	})
+
+	t.Run("Asterisk form", func(t *testing.T) {
+		reader := &chunkReader{
+			data:            "OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			numBytesPerRead: 5,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, AsteriskForm, r.RequestLine.Target.Form)
+	})
+
+	invalid := []struct {
+		name        string
+		requestLine string
+	}{
+		{"Invalid percent-encoding in path", "GET /bad%zz HTTP/1.1"},
+		{"Truncated percent-encoding in query", "GET /?q=%4 HTTP/1.1"},
+		{"Asterisk form with GET", "GET * HTTP/1.1"},
+		{"CONNECT without port", "CONNECT example.com HTTP/1.1"},
+		{"CONNECT with path", "CONNECT example.com:443/x HTTP/1.1"},
+		{"Relative path", "GET coffee HTTP/1.1"},
+		{"Absolute form without host", "GET http:///path HTTP/1.1"},
+		{"Fragment in target", "GET /page#top HTTP/1.1"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := &chunkReader{
+				data:            tt.requestLine + "\r\nHost: example.com\r\n\r\n",
+				numBytesPerRead: 5,
+			}
+			_, err := RequestFromReader(reader)
+			assert.ErrorIs(t, err, ErrInvalidTarget)
+		})
+	}
+}
+
+func TestRequestKeepAlive(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   string
+		headers   string
+		keepAlive bool
+	}{
+		{"HTTP/1.1 persists by default", "HTTP/1.1", "", true},
+		{"HTTP/1.1 with Connection close", "HTTP/1.1", "Connection: close\r\n", false},
+		{"HTTP/1.0 closes by default", "HTTP/1.0", "", false},
+		{"HTTP/1.0 with Connection keep-alive", "HTTP/1.0", "Connection: Keep-Alive\r\n", true},
+		{"HTTP/1.0 with keep-alive and close", "HTTP/1.0", "Connection: keep-alive, close\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := &chunkReader{
+				data:            "GET / " + tt.version + "\r\n" + tt.headers + "\r\n",
+				numBytesPerRead: 4,
+			}
+			r, err := RequestFromReader(reader)
+			require.NoError(t, err)
+			assert.Equal(t, tt.keepAlive, r.KeepAlive())
+		})
+	}
+
+	t.Run("HTTP/1.0 with Transfer-Encoding", func(t *testing.T) {
+		reader := &chunkReader{
+			data:            "POST / HTTP/1.0\r\nConnection: keep-alive\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			numBytesPerRead: 4,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(r.Body))
+		assert.False(t, r.KeepAlive())
+	})
+}
+
+func TestRequestWrite(t *testing.T) {
+	t.Run("Round trips parsed requests", func(t *testing.T) {
+		raws := []string{
+			"GET /coffee?size=large HTTP/1.1\r\nHost: localhost:42069\r\nAccept: */*\r\nAccept: text/plain\r\n\r\n",
+			"POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 13\r\n\r\nhello world!\n",
+			"GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n",
+		}
+		for _, raw := range raws {
+			reader := NewReader(&chunkReader{data: raw, numBytesPerRead: 3})
+			r, err := reader.ReadRequest()
+			require.NoError(t, err)
+
+			var buf strings.Builder
+			require.NoError(t, r.Write(&buf))
+			assert.Equal(t, raw, buf.String())
+		}
+	})
+
+	t.Run("Round trips a streamed chunked request", func(t *testing.T) {
+		raw := "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n"
+		r, err := NewReader(&chunkReader{data: raw, numBytesPerRead: 3}).ReadRequest()
+		require.NoError(t, err)
+
+		var buf strings.Builder
+		require.NoError(t, r.Write(&buf))
+		parsed, err := RequestFromReader(strings.NewReader(buf.String()))
+		require.NoError(t, err)
+		assert.Equal(t, r.RequestLine, parsed.RequestLine)
+		assert.Equal(t, r.Headers, parsed.Headers)
+		assert.Equal(t, "hello world", string(parsed.Body))
+		assert.Equal(t, "abc", parsed.Trailers.Get("X-Checksum"))
+	})
+
+	t.Run("Parsing the output gives back the request", func(t *testing.T) {
+		r := &Request{
+			RequestLine: RequestLine{Method: "PUT", RequestTarget: "/items/1", HttpVersion: "1.1"},
+			Headers:     headers.Headers{{Name: "Host", Value: "example.com"}},
+			Body:        []byte(`{"name":"mug"}`),
+		}
+		var buf strings.Builder
+		require.NoError(t, r.Write(&buf))
+		assert.Equal(t, "PUT /items/1 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 14\r\n\r\n{\"name\":\"mug\"}", buf.String())
+
+		parsed, err := RequestFromReader(strings.NewReader(buf.String()))
+		require.NoError(t, err)
+		assert.Equal(t, r.RequestLine.Method, parsed.RequestLine.Method)
+		assert.Equal(t, r.RequestLine.RequestTarget, parsed.RequestLine.RequestTarget)
+		assert.Equal(t, "example.com", parsed.Headers.Get("Host"))
+		assert.Equal(t, r.Body, parsed.Body)
+	})
+
+	t.Run("Streamed body is sent chunked with trailers", func(t *testing.T) {
+		r := &Request{
+			RequestLine: RequestLine{Method: "POST", RequestTarget: "/stream"},
+			Headers:     headers.Headers{{Name: "Host", Value: "example.com"}},
+			BodyReader:  io.NopCloser(strings.NewReader("streamed")),
+			Trailers:    headers.Headers{{Name: "X-Checksum", Value: "abc"}},
+		}
+		var buf strings.Builder
+		require.NoError(t, r.Write(&buf))
+
+		parsed, err := RequestFromReader(strings.NewReader(buf.String()))
+		require.NoError(t, err)
+		assert.Equal(t, "chunked", parsed.Headers.Get("Transfer-Encoding"))
+		assert.Equal(t, "streamed", string(parsed.Body))
+		assert.Equal(t, "abc", parsed.Trailers.Get("X-Checksum"))
+	})
+
+	t.Run("Body must match Content-Length", func(t *testing.T) {
+		for _, body := range []string{"shrt", "too long"} {
+			r := &Request{
+				RequestLine: RequestLine{Method: "POST", RequestTarget: "/"},
+				Headers:     headers.Headers{{Name: "Content-Length", Value: "5"}},
+				Body:        []byte(body),
+			}
+			assert.Error(t, r.Write(io.Discard))
+		}
+	})
+
+	t.Run("Invalid header values are refused", func(t *testing.T) {
+		r := &Request{
+			RequestLine: RequestLine{Method: "GET", RequestTarget: "/"},
+			Headers:     headers.Headers{{Name: "X-Bad", Value: "a\r\nInjected: 1"}},
+		}
+		assert.ErrorIs(t, r.Write(io.Discard), headers.ErrInvalidFieldValue)
+	})
+
+	t.Run("Invalid request lines are refused", func(t *testing.T) {
+		lines := []RequestLine{
+			{Method: "GET", RequestTarget: "/ HTTP/1.1\r\nX-Evil: 1\r\n\r\nGET /admin"},
+			{Method: "GET", RequestTarget: "/a\tb"},
+			{Method: "GET", RequestTarget: ""},
+			{Method: "GET /admin", RequestTarget: "/"},
+			{Method: "", RequestTarget: "/"},
+			{Method: "GET", RequestTarget: "/", HttpVersion: "1.1\r\nX-Evil: 1"},
+			{Method: "GET", RequestTarget: "/", HttpVersion: "one"},
+		}
+		for _, line := range lines {
+			r := &Request{RequestLine: line}
+			var buf strings.Builder
+			assert.Error(t, r.Write(&buf), "%+v", line)
+			assert.Empty(t, buf.String())
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package request
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+var ErrInvalidTarget = errors.New("invalid request target")
+
+// TargetForm is one of the four request-target forms of RFC 9112 section 3.2.
+type TargetForm int
+
+const (
+	OriginForm TargetForm = iota
+	AbsoluteForm
+	AuthorityForm
+	AsteriskForm
+)
+
+// Target is the parsed request-target. Path is percent-decoded, RawPath is
+// the path exactly as it was sent. Scheme and Host are only set for the
+// absolute and authority forms.
+type Target struct {
+	Form     TargetForm
+	Scheme   string
+	Host     string
+	Path     string
+	RawPath  string
+	RawQuery string
+}
+
+// Query parses RawQuery into its parameters.
+func (t Target) Query() url.Values {
+	values, _ := url.ParseQuery(t.RawQuery)
+	return values
+}
+
+func parseTarget(method, raw string) (Target, error) {
+	for i := 0; i < len(raw); i++ {
+		if raw[i] <= ' ' || raw[i] == 0x7f || raw[i] == '#' {
+			return Target{}, ErrInvalidTarget
+		}
+	}
+
+	switch {
+	case method == "CONNECT":
+		if !isAuthority(raw) {
+			return Target{}, ErrInvalidTarget
+		}
+		return Target{Form: AuthorityForm, Host: raw}, nil
+	case raw == "*":
+		if method != "OPTIONS" {
+			return Target{}, ErrInvalidTarget
+		}
+		return Target{Form: AsteriskForm}, nil
+	case strings.HasPrefix(raw, "/"):
+		target := Target{Form: OriginForm}
+		if err := target.setPathAndQuery(raw); err != nil {
+			return Target{}, err
+		}
+		return target, nil
+	default:
+		return parseAbsoluteTarget(raw)
+	}
+}
+
+func parseAbsoluteTarget(raw string) (Target, error) {
+	scheme, rest, ok := strings.Cut(raw, "://")
+	if !ok || !isScheme(scheme) {
+		return Target{}, ErrInvalidTarget
+	}
+	authorityEnd := strings.IndexAny(rest, "/?")
+	if authorityEnd == -1 {
+		authorityEnd = len(rest)
+	}
+	host := rest[:authorityEnd]
+	if host == "" || strings.Contains(host, "@") {
+		return Target{}, ErrInvalidTarget
+	}
+
+	target := Target{
+		Form:   AbsoluteForm,
+		Scheme: strings.ToLower(scheme),
+		Host:   host,
+	}
+	pathAndQuery := rest[authorityEnd:]
+	if !strings.HasPrefix(pathAndQuery, "/") {
+		pathAndQuery = "/" + pathAndQuery
+	}
+	if err := target.setPathAndQuery(pathAndQuery); err != nil {
+		return Target{}, err
+	}
+	return target, nil
+}
+
+func (t *Target) setPathAndQuery(raw string) error {
+	rawPath, rawQuery, _ := strings.Cut(raw, "?")
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return ErrInvalidTarget
+	}
+	if !validEscapes(rawQuery) {
+		return ErrInvalidTarget
+	}
+	t.Path = path
+	t.RawPath = rawPath
+	t.RawQuery = rawQuery
+	return nil
+}
+
+func validEscapes(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			continue
+		}
+		if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			return false
+		}
+		i += 2
+	}
+	return true
+}
+
+func isHex(ch byte) bool {
+	return ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'f' || ch >= 'A' && ch <= 'F'
+}
+
+func isScheme(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z':
+		case i > 0 && (ch >= '0' && ch <= '9' || ch == '+' || ch == '-' || ch == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isAuthority reports whether s is a host:port pair as used by CONNECT.
+func isAuthority(s string) bool {
+	colon := strings.LastIndexByte(s, ':')
+	if colon <= 0 || colon == len(s)-1 {
+		return false
+	}
+	if strings.ContainsAny(s, "/?@") {
+		return false
+	}
+	for _, ch := range s[colon+1:] {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
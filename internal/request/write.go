@@ -0,0 +1,99 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/glebson1988/httpfromtcp/internal/headers"
+	"github.com/glebson1988/httpfromtcp/internal/message"
+)
+
+// Write serializes the request as HTTP/1.1 bytes. The body comes from Body if
+// it is set and streams from BodyReader otherwise. Framing headers already
+// present are honoured; without them a body of known size gets a
+// Content-Length and a streamed body, or one with trailers, is sent chunked.
+// A request line or header field that could split the message is refused
+// before anything is written.
+func (r *Request) Write(w io.Writer) error {
+	version := r.RequestLine.HttpVersion
+	if version == "" {
+		version = "1.1"
+	}
+	if err := validateRequestLine(r.RequestLine.Method, r.RequestLine.RequestTarget, version); err != nil {
+		return err
+	}
+	if err := r.Headers.Validate(); err != nil {
+		return err
+	}
+
+	h := r.Headers.Clone()
+	body, size := r.bodySource()
+	if !h.Has("transfer-encoding") && !h.Has("content-length") {
+		switch {
+		case size < 0 || len(r.Trailers) > 0:
+			h.Set("Transfer-Encoding", "chunked")
+		case size > 0:
+			h.Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+	}
+	if _, _, err := message.BodyFraming(h); err != nil {
+		return err
+	}
+
+	line := fmt.Sprintf("%s %s HTTP/%s\r\n", r.RequestLine.Method, r.RequestLine.RequestTarget, version)
+	if _, err := io.WriteString(w, line); err != nil {
+		return err
+	}
+	if err := h.Write(w); err != nil {
+		return err
+	}
+	return message.WriteBody(w, h, body, &r.Trailers)
+}
+
+// validateRequestLine checks the parts of a request line Write is given, so
+// none of them can end the line early or smuggle in another request.
+func validateRequestLine(method, target, version string) error {
+	// A method is a token, the same grammar as a field name.
+	if !headers.ValidFieldName(method) {
+		return fmt.Errorf("invalid HTTP method: %q", method)
+	}
+	if !validRequestTarget(target) {
+		return fmt.Errorf("invalid request target: %q", target)
+	}
+	if !message.IsHTTPVersion("HTTP/" + version) {
+		return fmt.Errorf("invalid HTTP version: %q", version)
+	}
+	return nil
+}
+
+// validRequestTarget reports whether target is non-empty and free of spaces
+// and control characters.
+func validRequestTarget(target string) bool {
+	if target == "" {
+		return false
+	}
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// bodySource returns the reader to take the body from and its size, or -1 if
+// it is only known once the reader is exhausted. A parsed request without
+// framing headers has no body.
+func (r *Request) bodySource() (io.Reader, int64) {
+	if r.Body != nil {
+		return bytes.NewReader(r.Body), int64(len(r.Body))
+	}
+	if r.BodyReader == nil {
+		return nil, 0
+	}
+	if r.body != nil && !r.Headers.Has("transfer-encoding") && !r.Headers.Has("content-length") {
+		return nil, 0
+	}
+	return r.BodyReader, -1
+}
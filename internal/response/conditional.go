@@ -0,0 +1,212 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/glebson1988/httpfromtcp/internal/headers"
+)
+
+// SetRequestHeaders gives the writer the fields of the request it answers, so
+// that the conditions of a conditional request can be evaluated.
+func (w *Writer) SetRequestHeaders(h Headers) {
+	w.request = h
+}
+
+// SetETag declares the entity-tag of the response as its ETag field. tag is
+// the opaque part without quotes, and weak marks it as only semantically
+// equivalent between versions.
+func (w *Writer) SetETag(tag string, weak bool) error {
+	for i := 0; i < len(tag); i++ {
+		if tag[i] == '"' || tag[i] <= ' ' || tag[i] == 0x7f {
+			return fmt.Errorf("invalid entity-tag: %q", tag)
+		}
+	}
+	value := `"` + tag + `"`
+	if weak {
+		value = "W/" + value
+	}
+	w.header.Set("ETag", value)
+	return nil
+}
+
+// SetLastModified declares when the representation last changed as its
+// Last-Modified field.
+func (w *Writer) SetLastModified(t time.Time) {
+	w.header.Set("Last-Modified", headers.FormatTime(t))
+}
+
+// ComputeETag makes the writer derive a strong ETag from the body when the
+// handler hasn't declared one and the whole body is buffered by Write, so
+// repeated requests for unchanged content can be answered with 304.
+func (w *Writer) ComputeETag() {
+	w.computeETag = true
+}
+
+// CheckPreconditions evaluates the request's conditions against the ETag and
+// Last-Modified fields declared so far. If one fails it sends the 304 or 412
+// response and returns false, and the handler should stop. Responses written
+// through Write, Flush or Finish are checked the same way when they commit,
+// so calling it only matters to skip producing a body that won't be sent.
+func (w *Writer) CheckPreconditions() bool {
+	if w.preconditionsChecked {
+		return !w.preconditionFailed
+	}
+	if w.state != writerStateStatusLine {
+		return true
+	}
+	status := w.evaluatePreconditions()
+	if status == 0 {
+		return true
+	}
+	_ = w.writePreconditionFailure(status)
+	return false
+}
+
+// evaluatePreconditions applies the conditional request fields in the order
+// of RFC 9110 section 13.2.2 and returns 304 or 412 if one of them fails, or 0
+// if the response should be sent as it is. Conditions only apply to responses
+// that would otherwise be 2xx.
+func (w *Writer) evaluatePreconditions() StatusCode {
+	w.preconditionsChecked = true
+	status := w.status
+	if status == 0 {
+		status = StatusOK
+	}
+	if status/100 != 2 {
+		return 0
+	}
+
+	etag := w.header.Get("ETag")
+	lastModified, hasLastModified := w.lastModified()
+	safe := w.method == "GET" || w.method == "HEAD"
+
+	if ifMatch := w.request.Get("If-Match"); ifMatch != "" {
+		if !matchETag(ifMatch, etag, true) {
+			return StatusPreconditionFailed
+		}
+	} else if since, ok := requestTime(w.request, "If-Unmodified-Since"); ok && hasLastModified {
+		if lastModified.After(since) {
+			return StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := w.request.Get("If-None-Match"); ifNoneMatch != "" {
+		if matchETag(ifNoneMatch, etag, false) {
+			if safe {
+				return StatusNotModified
+			}
+			return StatusPreconditionFailed
+		}
+	} else if since, ok := requestTime(w.request, "If-Modified-Since"); ok && hasLastModified && safe {
+		if !lastModified.After(since) {
+			return StatusNotModified
+		}
+	}
+	return 0
+}
+
+// writePreconditionFailure replaces the response with a 304 that keeps the
+// validators and other metadata, or with a plain 412.
+func (w *Writer) writePreconditionFailure(status StatusCode) error {
+	w.preconditionsChecked = true
+	w.preconditionFailed = true
+	w.status = status
+	if status == StatusNotModified {
+		for _, name := range []string{"Content-Type", "Content-Length", "Content-Range", "Transfer-Encoding", "Trailer"} {
+			w.header.Del(name)
+		}
+		w.buf = nil
+	} else {
+		w.header = Headers{{Name: "Content-Type", Value: "text/plain"}}
+		w.buf = []byte("precondition failed")
+	}
+	return w.commit(true)
+}
+
+func (w *Writer) setComputedETag() {
+	if !w.computeETag || w.header.Has("ETag") {
+		return
+	}
+	sum := sha256.Sum256(w.buf)
+	_ = w.SetETag(hex.EncodeToString(sum[:16]), false)
+}
+
+func (w *Writer) lastModified() (time.Time, bool) {
+	value := w.header.Get("Last-Modified")
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := headers.ParseTime(value)
+	return t, err == nil
+}
+
+// requestTime parses an HTTP-date condition. Invalid dates are ignored, as
+// are repeated fields.
+func requestTime(h Headers, key string) (time.Time, bool) {
+	values := h.Values(key)
+	if len(values) != 1 {
+		return time.Time{}, false
+	}
+	t, err := headers.ParseTime(values[0])
+	return t, err == nil
+}
+
+// matchETag reports whether the If-Match or If-None-Match list matches etag.
+// "*" matches any current representation. strong selects the strong
+// comparison of RFC 9110 section 8.8.3.2, where weak tags never match.
+func matchETag(list, etag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if etag == "" || (strong && isWeak(etag)) {
+		return false
+	}
+	for _, candidate := range parseETagList(list) {
+		if strong && isWeak(candidate) {
+			continue
+		}
+		if opaqueTag(candidate) == opaqueTag(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseETagList splits a list of entity-tags. Commas may appear inside the
+// quotes, so the list can't simply be split on them. Parsing stops at the
+// first malformed element.
+func parseETagList(list string) []string {
+	var tags []string
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			return tags
+		}
+		start := 0
+		if strings.HasPrefix(list, "W/") {
+			start = len("W/")
+		}
+		if len(list) <= start || list[start] != '"' {
+			return tags
+		}
+		end := strings.IndexByte(list[start+1:], '"')
+		if end == -1 {
+			return tags
+		}
+		end += start + 2
+		tags = append(tags, list[:end])
+		list = list[end:]
+	}
+}
+
+func isWeak(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
+
+func opaqueTag(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
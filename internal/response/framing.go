@@ -0,0 +1,169 @@
+package response
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// maxBufferedBody is how much of a body Write holds back to send it with a
+// Content-Length before switching to chunked encoding.
+const maxBufferedBody = 4 << 10
+
+// Header returns the fields sent along with the status line that Write, Flush
+// or Finish write on the handler's behalf. Changes after that have no effect.
+func (w *Writer) Header() *Headers {
+	return &w.header
+}
+
+// SetStatus sets the status code Write, Flush or Finish send when the
+// handler hasn't written a status line itself. It defaults to 200.
+func (w *Writer) SetStatus(statusCode StatusCode) {
+	w.status = statusCode
+}
+
+// Write implements io.Writer. Before the headers are out, small bodies are
+// buffered and sent with a Content-Length once the handler is done; larger
+// ones switch to chunked encoding. After WriteHeaders it writes body bytes in
+// whatever framing the headers declared, and may be called repeatedly.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.body != nil && w.state != writerStateDone {
+		return w.body.Write(p)
+	}
+	return w.writeUnwrapped(p)
+}
+
+// writeUnwrapped is Write without the body wrappers, which write their
+// output through it.
+func (w *Writer) writeUnwrapped(p []byte) (int, error) {
+	switch w.state {
+	case writerStateStatusLine, writerStateHeaders:
+		if n, ok := w.declaredLength(); ok && int64(len(w.buf)+len(p)) > n {
+			return 0, ErrContentLengthExceeded
+		}
+		w.buf = append(w.buf, p...)
+		if len(w.buf) > maxBufferedBody {
+			if err := w.commit(false); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	case writerStateBody:
+		return w.writeBody(p)
+	default:
+		return 0, fmt.Errorf("response body already complete")
+	}
+}
+
+// declaredLength returns the Content-Length the handler set in Header, which
+// a buffered body must not exceed either. Bytes written through a body
+// wrapper aren't the ones it counts, so they aren't checked here.
+func (w *Writer) declaredLength() (int64, bool) {
+	if w.wrapped || w.dropsBody() || w.header.HasToken("transfer-encoding", "chunked") {
+		return 0, false
+	}
+	if !w.header.Has("content-length") {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(w.header.Get("content-length"), 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// Flush sends the status line, headers and anything buffered so far, which
+// commits the response to chunked encoding unless a Content-Length was set.
+func (w *Writer) Flush() error {
+	if err := w.flushWrappers(); err != nil {
+		return err
+	}
+	if w.state == writerStateStatusLine || w.state == writerStateHeaders {
+		if err := w.commit(false); err != nil {
+			return err
+		}
+	}
+	if f, ok := w.writer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Finish completes the response once the handler returns: it writes a
+// default 200 if nothing was written, sends a buffered body with its
+// Content-Length, or ends a chunked body. Then it runs the OnFinish hooks.
+func (w *Writer) Finish() error {
+	err := w.finish()
+	w.runFinishHooks(err)
+	return err
+}
+
+func (w *Writer) finish() error {
+	if w.state != writerStateDone {
+		if err := w.closeWrappers(); err != nil {
+			return err
+		}
+	}
+	if w.state == writerStateStatusLine || w.state == writerStateHeaders {
+		if err := w.commit(true); err != nil {
+			return err
+		}
+	}
+	if w.state != writerStateBody {
+		return nil
+	}
+	if w.chunked {
+		_, err := w.WriteChunkedBodyDone()
+		return err
+	}
+	w.state = writerStateDone
+	return nil
+}
+
+// commit writes the status line and headers on the handler's behalf, then the
+// buffered body. complete tells whether the buffer holds the whole body.
+func (w *Writer) commit(complete bool) error {
+	if w.state == writerStateStatusLine && !w.preconditionsChecked {
+		if complete {
+			w.setComputedETag()
+		}
+		if status := w.evaluatePreconditions(); status != 0 {
+			return w.writePreconditionFailure(status)
+		}
+	}
+	if w.state == writerStateStatusLine {
+		if w.status == 0 {
+			w.status = StatusOK
+		}
+		if err := w.WriteStatusLine(w.status); err != nil {
+			return err
+		}
+	}
+
+	headers := w.runHeaderHooks(w.header)
+	framed := headers.Has("content-length") || headers.HasToken("transfer-encoding", "chunked")
+	if !framed && w.status.AllowsBody() {
+		if complete {
+			headers.Set("Content-Length", strconv.Itoa(len(w.buf)))
+		} else {
+			headers.Set("Transfer-Encoding", "chunked")
+		}
+	}
+	if err := w.WriteHeaders(headers); err != nil {
+		return err
+	}
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 || !w.status.AllowsBody() {
+		return nil
+	}
+	_, err := w.writeBody(buf)
+	return err
+}
+
+func (w *Writer) writeBody(p []byte) (int, error) {
+	if w.chunked {
+		return w.writeChunk(p)
+	}
+	return w.writePayload(p)
+}
@@ -0,0 +1,409 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/glebson1988/httpfromtcp/internal/headers"
+	"github.com/glebson1988/httpfromtcp/internal/message"
+)
+
+var (
+	ErrStatusLineTooLong = errors.New("status line too long")
+	ErrHeadersTooLarge   = message.ErrHeadersTooLarge
+	ErrTooManyHeaders    = message.ErrTooManyHeaders
+	ErrBodyTooLarge      = message.ErrBodyTooLarge
+)
+
+// Response is a response read off the wire by a Reader.
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	Trailers   headers.Headers
+	// BodyReader streams the message body as it arrives on the connection.
+	BodyReader io.ReadCloser
+	// Body holds the whole body once ReadBody has been called.
+	Body  []byte
+	state parserState
+
+	method         string
+	limits         message.Limits
+	closeDelimited bool
+	fields         message.FieldParser
+	bodyRemaining  int64
+	bodyTotal      int64
+	chunkRemaining int
+	sink           message.Sink
+	body           *message.Body
+}
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+type parserState int
+
+const (
+	parserStateInitialized parserState = iota
+	parserStateParsingHeaders
+	parserStateParsingBody
+	parserStateParsingBodyUntilClose
+	parserStateParsingChunkSize
+	parserStateParsingChunkData
+	parserStateParsingChunkEnd
+	parserStateParsingTrailers
+	parserStateDone
+)
+
+const readBufferSize = 4 << 10
+
+// Reader parses responses from a connection. MaxStartLineBytes in Limits
+// bounds the status line.
+type Reader struct {
+	Limits message.Limits
+
+	stream  *message.Stream
+	current *Response
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		Limits: message.DefaultLimits,
+		stream: message.NewStream(reader, readBufferSize),
+	}
+}
+
+// ResponseFromReader parses the final response to a request sent with method,
+// skipping any interim 1xx responses before it, and buffers its whole body
+// into Body. Use a Reader to stream bodies instead.
+func ResponseFromReader(reader io.Reader, method string) (*Response, error) {
+	r := NewReader(reader)
+	for {
+		resp, err := r.ReadResponse(method)
+		if err != nil {
+			return nil, err
+		}
+		if resp.IsInterim() {
+			continue
+		}
+		if _, err := resp.ReadBody(); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// ReadResponse parses the next status line and headers and returns as soon
+// as the headers are complete. method is the method of the request being
+// answered, which decides whether a body follows. Interim 1xx responses are
+// returned like any other, so callers expecting a final response call again.
+// The body is read lazily through BodyReader and must be consumed before the
+// next call. It returns io.EOF if the reader is exhausted before any byte of
+// a new response arrives.
+func (r *Reader) ReadResponse(method string) (*Response, error) {
+	if r.current != nil && r.current.state != parserStateDone {
+		return nil, fmt.Errorf("previous response body was not fully read")
+	}
+
+	resp := &Response{
+		state:  parserStateInitialized,
+		method: method,
+		limits: r.Limits,
+		fields: message.FieldParser{MaxBytes: r.Limits.MaxHeaderBytes, MaxCount: r.Limits.MaxHeaderCount},
+	}
+	err := r.advance(resp, resp.headersDone)
+	if err == io.ErrUnexpectedEOF && resp.state == parserStateInitialized && r.stream.Buffered() == 0 {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp.body = message.NewBody(&resp.sink, resp.done, func(done func() bool) error {
+		return r.advance(resp, done)
+	})
+	resp.BodyReader = resp.body
+	r.current = resp
+	return resp, nil
+}
+
+// advance feeds the stream to the response parser until done reports true.
+// The end of the stream completes a close-delimited body.
+func (r *Reader) advance(resp *Response, done func() bool) error {
+	return r.stream.Advance(resp.parse, func() bool {
+		if r.stream.Drained() && resp.state == parserStateParsingBodyUntilClose {
+			resp.state = parserStateDone
+		}
+		return done()
+	})
+}
+
+// ReadBody reads the rest of the body into Body and returns it.
+func (r *Response) ReadBody() ([]byte, error) {
+	if r.BodyReader == nil {
+		return r.Body, nil
+	}
+	data, err := io.ReadAll(r.BodyReader)
+	r.Body = append(r.Body, data...)
+	if err != nil {
+		return r.Body, err
+	}
+	return r.Body, nil
+}
+
+// IsInterim reports whether this is a 1xx response that precedes the final
+// one. 101 Switching Protocols is final: the connection changes protocol
+// right after it.
+func (r *Response) IsInterim() bool {
+	return r.StatusLine.StatusCode.IsInformational() && r.StatusLine.StatusCode != StatusSwitchingProtocols
+}
+
+// KeepAlive reports whether the connection can carry another request once
+// this response has been read. A close-delimited body always ends it.
+func (r *Response) KeepAlive() bool {
+	if r.closeDelimited || r.Headers.HasToken("connection", "close") {
+		return false
+	}
+	if r.StatusLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken("connection", "keep-alive")
+	}
+	return true
+}
+
+func (r *Response) headersDone() bool {
+	return r.state > parserStateParsingHeaders
+}
+
+func (r *Response) done() bool {
+	return r.state == parserStateDone
+}
+
+// hasBody applies the RFC 9112 section 6.3 rules for responses that never
+// carry content, whatever their framing headers say.
+func (r *Response) hasBody() bool {
+	if r.method == "HEAD" {
+		return false
+	}
+	if r.method == "CONNECT" && r.StatusLine.StatusCode/100 == 2 {
+		return false
+	}
+	return r.StatusLine.StatusCode.AllowsBody()
+}
+
+func parseStatusLine(data []byte) (StatusLine, int, error) {
+	lineEnd := bytes.Index(data, []byte("\r\n"))
+	if lineEnd == -1 {
+		return StatusLine{}, 0, nil
+	}
+	line := string(data[:lineEnd])
+	version, rest, ok := strings.Cut(line, " ")
+	if !ok || !message.IsHTTPVersion(version) {
+		return StatusLine{}, 0, fmt.Errorf("invalid status line: %s", line)
+	}
+	if version[len("HTTP/")] != '1' {
+		return StatusLine{}, 0, fmt.Errorf("%w: %s", message.ErrUnsupportedVersion, version)
+	}
+	code, reason, _ := strings.Cut(rest, " ")
+	if len(code) != 3 || strings.Trim(code, "0123456789") != "" {
+		return StatusLine{}, 0, fmt.Errorf("invalid status code: %s", code)
+	}
+	n, _ := strconv.Atoi(code)
+	if err := validateStatusCode(StatusCode(n)); err != nil {
+		return StatusLine{}, 0, err
+	}
+	if !validReasonPhrase(reason) {
+		return StatusLine{}, 0, fmt.Errorf("invalid reason phrase: %q", reason)
+	}
+	return StatusLine{
+		HttpVersion:  strings.TrimPrefix(version, "HTTP/"),
+		StatusCode:   StatusCode(n),
+		ReasonPhrase: reason,
+	}, lineEnd + len("\r\n"), nil
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	totalBytesParsed := 0
+	for r.state != parserStateDone {
+		n, err := r.parseSingle(data[totalBytesParsed:])
+		if err != nil {
+			return totalBytesParsed, err
+		}
+		if n == 0 {
+			return totalBytesParsed, nil
+		}
+		totalBytesParsed += n
+	}
+	return totalBytesParsed, nil
+}
+
+func (r *Response) parseSingle(data []byte) (int, error) {
+	switch r.state {
+	case parserStateInitialized:
+		statusLine, consumed, err := parseStatusLine(data)
+		if err != nil {
+			return 0, err
+		}
+		if consumed == 0 {
+			if message.Exceeds(len(data), r.limits.MaxStartLineBytes) {
+				return 0, ErrStatusLineTooLong
+			}
+			return 0, nil
+		}
+		if message.Exceeds(consumed-len("\r\n"), r.limits.MaxStartLineBytes) {
+			return 0, ErrStatusLineTooLong
+		}
+		r.StatusLine = statusLine
+		r.state = parserStateParsingHeaders
+		return consumed, nil
+	case parserStateParsingHeaders:
+		if r.Headers == nil {
+			r.Headers = headers.Headers{}
+		}
+		consumed, done, err := r.fields.Parse(&r.Headers, data)
+		if err != nil {
+			return 0, err
+		}
+		if consumed == 0 {
+			return 0, nil
+		}
+		if done {
+			if err := r.startBody(); err != nil {
+				return 0, err
+			}
+		}
+		return consumed, nil
+	case parserStateParsingBody:
+		toRead := r.sink.Space(len(data))
+		if int64(toRead) > r.bodyRemaining {
+			toRead = int(r.bodyRemaining)
+		}
+		r.sink.Fill(data[:toRead])
+		r.bodyRemaining -= int64(toRead)
+		if r.bodyRemaining == 0 {
+			r.state = parserStateDone
+		}
+		return toRead, nil
+	case parserStateParsingBodyUntilClose:
+		toRead := r.sink.Space(len(data))
+		r.bodyTotal += int64(toRead)
+		if r.limits.MaxBodyBytes > 0 && r.bodyTotal > r.limits.MaxBodyBytes {
+			return 0, ErrBodyTooLarge
+		}
+		r.sink.Fill(data[:toRead])
+		return toRead, nil
+	case parserStateParsingChunkSize:
+		size, consumed, err := message.ParseChunkSize(data)
+		if err != nil {
+			return 0, err
+		}
+		if consumed == 0 {
+			return 0, nil
+		}
+		r.bodyTotal += int64(size)
+		if r.limits.MaxBodyBytes > 0 && r.bodyTotal > r.limits.MaxBodyBytes {
+			return 0, ErrBodyTooLarge
+		}
+		if size == 0 {
+			r.Trailers = headers.Headers{}
+			r.state = parserStateParsingTrailers
+		} else {
+			r.chunkRemaining = size
+			r.state = parserStateParsingChunkData
+		}
+		return consumed, nil
+	case parserStateParsingChunkData:
+		toRead := r.sink.Space(len(data))
+		if toRead > r.chunkRemaining {
+			toRead = r.chunkRemaining
+		}
+		r.sink.Fill(data[:toRead])
+		r.chunkRemaining -= toRead
+		if r.chunkRemaining == 0 {
+			r.state = parserStateParsingChunkEnd
+		}
+		return toRead, nil
+	case parserStateParsingChunkEnd:
+		if len(data) < len("\r\n") {
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, []byte("\r\n")) {
+			return 0, fmt.Errorf("missing CRLF after chunk data")
+		}
+		r.state = parserStateParsingChunkSize
+		return len("\r\n"), nil
+	case parserStateParsingTrailers:
+		consumed, done, err := r.fields.Parse(&r.Trailers, data)
+		if err != nil {
+			return 0, err
+		}
+		if consumed == 0 {
+			return 0, nil
+		}
+		if done {
+			r.state = parserStateDone
+		}
+		return consumed, nil
+	case parserStateDone:
+		return 0, fmt.Errorf("error: trying to read data in a done state")
+	default:
+		return 0, fmt.Errorf("error: unknown state")
+	}
+}
+
+// startBody picks the body framing once the headers are in. Unlike requests,
+// a response without Content-Length, or whose final transfer coding isn't
+// chunked, is delimited by the server closing the connection. When chunked
+// follows other codings it still delimits the body, and the codings under it
+// are left to the caller.
+func (r *Response) startBody() error {
+	if !r.hasBody() {
+		r.state = parserStateDone
+		return nil
+	}
+	chunked, contentLength, err := message.BodyFraming(r.Headers)
+	if errors.Is(err, message.ErrUnsupportedTransferEncoding) || errors.Is(err, message.ErrInvalidTransferEncoding) {
+		codings := strings.Split(r.Headers.Get("transfer-encoding"), ",")
+		last := len(codings) - 1
+		switch {
+		case !isChunked(codings[last]):
+			r.closeDelimited = true
+			r.state = parserStateParsingBodyUntilClose
+			return nil
+		case errors.Is(err, message.ErrUnsupportedTransferEncoding) && !slices.ContainsFunc(codings[:last], isChunked):
+			chunked, err = true, nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if chunked {
+		r.state = parserStateParsingChunkSize
+		return nil
+	}
+	if !r.Headers.Has("content-length") {
+		r.closeDelimited = true
+		r.state = parserStateParsingBodyUntilClose
+		return nil
+	}
+	if contentLength == 0 {
+		r.state = parserStateDone
+		return nil
+	}
+	if r.limits.MaxBodyBytes > 0 && contentLength > r.limits.MaxBodyBytes {
+		return ErrBodyTooLarge
+	}
+	r.bodyRemaining = contentLength
+	r.state = parserStateParsingBody
+	return nil
+}
+
+func isChunked(coding string) bool {
+	return strings.EqualFold(strings.TrimSpace(coding), "chunked")
+}
@@ -0,0 +1,316 @@
+package response
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/glebson1988/httpfromtcp/internal/message"
+)
+
+func TestResponseFromReader(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		raw          string
+		wantStatus   StatusCode
+		wantReason   string
+		wantBody     string
+		wantTrailers string
+		wantKeep     bool
+	}{
+		{
+			name:       "content length",
+			method:     "GET",
+			raw:        "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			wantStatus: StatusOK,
+			wantReason: "OK",
+			wantBody:   "hello",
+			wantKeep:   true,
+		},
+		{
+			name:         "chunked with trailers",
+			method:       "GET",
+			raw:          "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n",
+			wantStatus:   StatusOK,
+			wantReason:   "OK",
+			wantBody:     "hello world",
+			wantTrailers: "abc",
+			wantKeep:     true,
+		},
+		{
+			name:       "close delimited",
+			method:     "GET",
+			raw:        "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the end",
+			wantStatus: StatusOK,
+			wantReason: "OK",
+			wantBody:   "until the end",
+		},
+		{
+			name:       "unknown transfer coding is close delimited",
+			method:     "GET",
+			raw:        "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\n\r\nraw",
+			wantStatus: StatusOK,
+			wantReason: "OK",
+			wantBody:   "raw",
+		},
+		{
+			name:       "chunked after another coding is still chunked",
+			method:     "GET",
+			raw:        "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip, chunked\r\n\r\n3\r\nraw\r\n0\r\n\r\n",
+			wantStatus: StatusOK,
+			wantReason: "OK",
+			wantBody:   "raw",
+			wantKeep:   true,
+		},
+		{
+			name:       "chunked before another coding is close delimited",
+			method:     "GET",
+			raw:        "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked, gzip\r\n\r\n3\r\nraw",
+			wantStatus: StatusOK,
+			wantReason: "OK",
+			wantBody:   "3\r\nraw",
+		},
+		{
+			name:       "HEAD ignores Content-Length",
+			method:     "HEAD",
+			raw:        "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n",
+			wantStatus: StatusOK,
+			wantReason: "OK",
+			wantKeep:   true,
+		},
+		{
+			name:       "204 has no body",
+			method:     "DELETE",
+			raw:        "HTTP/1.1 204 No Content\r\n\r\n",
+			wantStatus: StatusNoContent,
+			wantReason: "No Content",
+			wantKeep:   true,
+		},
+		{
+			name:       "304 ignores chunked",
+			method:     "GET",
+			raw:        "HTTP/1.1 304 Not Modified\r\nTransfer-Encoding: chunked\r\n\r\n",
+			wantStatus: StatusNotModified,
+			wantReason: "Not Modified",
+			wantKeep:   true,
+		},
+		{
+			name:       "interim responses are skipped",
+			method:     "POST",
+			raw:        "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok",
+			wantStatus: StatusCreated,
+			wantReason: "Created",
+			wantBody:   "ok",
+			wantKeep:   true,
+		},
+		{
+			name:       "empty reason phrase",
+			method:     "GET",
+			raw:        "HTTP/1.1 599 \r\nContent-Length: 0\r\n\r\n",
+			wantStatus: 599,
+			wantKeep:   true,
+		},
+		{
+			name:       "HTTP/1.0 closes by default",
+			method:     "GET",
+			raw:        "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			wantStatus: StatusOK,
+			wantReason: "OK",
+			wantBody:   "ok",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := iotest.OneByteReader(strings.NewReader(tt.raw))
+			resp, err := ResponseFromReader(reader, tt.method)
+			if err != nil {
+				t.Fatalf("ResponseFromReader returned error: %v", err)
+			}
+			if resp.StatusLine.StatusCode != tt.wantStatus || resp.StatusLine.ReasonPhrase != tt.wantReason {
+				t.Fatalf("unexpected status line: %+v", resp.StatusLine)
+			}
+			if string(resp.Body) != tt.wantBody {
+				t.Fatalf("unexpected body: %q", resp.Body)
+			}
+			if got := resp.Trailers.Get("X-Checksum"); got != tt.wantTrailers {
+				t.Fatalf("unexpected trailer: %q", got)
+			}
+			if resp.KeepAlive() != tt.wantKeep {
+				t.Fatalf("KeepAlive = %v, want %v", resp.KeepAlive(), tt.wantKeep)
+			}
+		})
+	}
+}
+
+func TestResponseFromReaderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr error
+	}{
+		{name: "truncated body", raw: "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort", wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated chunked body", raw: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel", wantErr: io.ErrUnexpectedEOF},
+		{name: "unsupported version", raw: "HTTP/2.0 200 OK\r\n\r\n", wantErr: message.ErrUnsupportedVersion},
+		{name: "conflicting lengths", raw: "HTTP/1.1 200 OK\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab", wantErr: message.ErrConflictingContentLength},
+		{name: "length with chunked", raw: "HTTP/1.1 200 OK\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n", wantErr: message.ErrContentLengthWithTransferEncoding},
+		{name: "chunked applied twice", raw: "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip, chunked, chunked\r\n\r\n", wantErr: message.ErrUnsupportedTransferEncoding},
+		{name: "header fields too large", raw: "HTTP/1.1 200 OK\r\nX-Big: " + strings.Repeat("b", 64<<10) + "\r\n\r\n", wantErr: ErrHeadersTooLarge},
+		{name: "status line too long", raw: "HTTP/1.1 200 " + strings.Repeat("a", 9<<10) + "\r\n\r\n", wantErr: ErrStatusLineTooLong},
+		{name: "two digit status", raw: "HTTP/1.1 20 OK\r\n\r\n"},
+		{name: "missing status code", raw: "HTTP/1.1\r\n\r\n"},
+		{name: "bad field", raw: "HTTP/1.1 200 OK\r\nBad Field: x\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ResponseFromReader(strings.NewReader(tt.raw), "GET")
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestReaderSequentialResponses(t *testing.T) {
+	raw := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nfirst" +
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nsecond\r\n0\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"
+	reader := NewReader(strings.NewReader(raw))
+
+	for _, tc := range []struct {
+		method string
+		body   string
+	}{{"GET", "first"}, {"GET", "second"}, {"HEAD", ""}} {
+		resp, err := reader.ReadResponse(tc.method)
+		if err != nil {
+			t.Fatalf("ReadResponse returned error: %v", err)
+		}
+		body, err := io.ReadAll(resp.BodyReader)
+		if err != nil {
+			t.Fatalf("reading body: %v", err)
+		}
+		if string(body) != tc.body {
+			t.Fatalf("unexpected body: %q", body)
+		}
+	}
+
+	if _, err := reader.ReadResponse("GET"); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestReaderRequiresBodyRead(t *testing.T) {
+	raw := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhelloHTTP/1.1 204 No Content\r\n\r\n"
+	reader := NewReader(strings.NewReader(raw))
+	if _, err := reader.ReadResponse("GET"); err != nil {
+		t.Fatalf("ReadResponse returned error: %v", err)
+	}
+	if _, err := reader.ReadResponse("GET"); err == nil {
+		t.Fatalf("expected an error while the previous body is unread")
+	}
+}
+
+func TestResponseWrite(t *testing.T) {
+	t.Run("round trips parsed responses", func(t *testing.T) {
+		tests := []struct {
+			method string
+			raw    string
+		}{
+			{"GET", "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello"},
+			{"GET", "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\n\r\n"},
+			{"HEAD", "HTTP/1.1 200 OK\r\nContent-Length: 1024\r\n\r\n"},
+			{"GET", "HTTP/1.0 404 Not Found\r\nContent-Length: 0\r\n\r\n"},
+		}
+		for _, tt := range tests {
+			resp, err := NewReader(iotest.OneByteReader(strings.NewReader(tt.raw))).ReadResponse(tt.method)
+			if err != nil {
+				t.Fatalf("ReadResponse returned error: %v", err)
+			}
+			var buf strings.Builder
+			if err := resp.Write(&buf); err != nil {
+				t.Fatalf("Write returned error: %v", err)
+			}
+			if buf.String() != tt.raw {
+				t.Fatalf("round trip changed the response:\n got %q\nwant %q", buf.String(), tt.raw)
+			}
+		}
+	})
+
+	t.Run("round trips a streamed chunked response", func(t *testing.T) {
+		raw := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n"
+		resp, err := NewReader(iotest.OneByteReader(strings.NewReader(raw))).ReadResponse("GET")
+		if err != nil {
+			t.Fatalf("ReadResponse returned error: %v", err)
+		}
+		var buf strings.Builder
+		if err := resp.Write(&buf); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+		parsed, err := ResponseFromReader(strings.NewReader(buf.String()), "GET")
+		if err != nil {
+			t.Fatalf("ResponseFromReader returned error: %v", err)
+		}
+		if parsed.StatusLine != resp.StatusLine || parsed.Headers.Get("Trailer") != "X-Checksum" {
+			t.Fatalf("unexpected response: %+v %v", parsed.StatusLine, parsed.Headers)
+		}
+		if string(parsed.Body) != "hello world" || parsed.Trailers.Get("X-Checksum") != "abc" {
+			t.Fatalf("unexpected body or trailers: %q %v", parsed.Body, parsed.Trailers)
+		}
+	})
+
+	t.Run("frames a constructed response", func(t *testing.T) {
+		resp := &Response{
+			StatusLine: StatusLine{StatusCode: StatusCreated},
+			Headers:    Headers{{Name: "Location", Value: "/items/1"}},
+			Body:       []byte{},
+		}
+		var buf strings.Builder
+		if err := resp.Write(&buf); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+		want := "HTTP/1.1 201 Created\r\nLocation: /items/1\r\nContent-Length: 0\r\n\r\n"
+		if buf.String() != want {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+	})
+
+	t.Run("streamed body is chunked and parses back", func(t *testing.T) {
+		resp := &Response{
+			StatusLine: StatusLine{StatusCode: StatusOK, ReasonPhrase: "Fine"},
+			BodyReader: io.NopCloser(strings.NewReader("streamed body")),
+			Trailers:   Headers{{Name: "X-Checksum", Value: "abc"}},
+		}
+		var buf strings.Builder
+		if err := resp.Write(&buf); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+		parsed, err := ResponseFromReader(strings.NewReader(buf.String()), "GET")
+		if err != nil {
+			t.Fatalf("ResponseFromReader returned error: %v", err)
+		}
+		if parsed.StatusLine.ReasonPhrase != "Fine" || string(parsed.Body) != "streamed body" {
+			t.Fatalf("unexpected response: %+v %q", parsed.StatusLine, parsed.Body)
+		}
+		if parsed.Trailers.Get("X-Checksum") != "abc" {
+			t.Fatalf("unexpected trailers: %v", parsed.Trailers)
+		}
+	})
+
+	t.Run("refuses a body that does not match Content-Length", func(t *testing.T) {
+		resp := &Response{
+			StatusLine: StatusLine{StatusCode: StatusOK},
+			Headers:    Headers{{Name: "Content-Length", Value: "10"}},
+			Body:       []byte("short"),
+		}
+		if err := resp.Write(io.Discard); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
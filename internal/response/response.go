@@ -1,21 +1,17 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
 
 	"github.com/glebson1988/httpfromtcp/internal/headers"
 )
 
 type Headers = headers.Headers
 
-type StatusCode int
-
-const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
-)
+var ErrContentLengthExceeded = errors.New("response body exceeds declared Content-Length")
 
 type writerState int
 
@@ -27,44 +23,213 @@ const (
 )
 
 type Writer struct {
-	writer io.Writer
-	state  writerState
+	writer    io.Writer
+	state     writerState
+	closeConn bool
+	http10    bool
+	unchunked bool
+	chunked   bool
+	head      bool
+
+	status StatusCode
+	header Headers
+	buf    []byte
+
+	method               string
+	request              Headers
+	computeETag          bool
+	preconditionsChecked bool
+	preconditionFailed   bool
+
+	contentLength int64
+	written       int64
+
+	headerHooks []func(StatusCode, *Headers)
+	hooksDone   bool
+	finishHooks []func(error)
+	sent        Headers
+	body        io.Writer
+	wrappers    []io.WriteCloser
+	wrapped     bool
 }
 
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
-		writer: w,
-		state:  writerStateStatusLine,
+		writer:        w,
+		state:         writerStateStatusLine,
+		contentLength: -1,
 	}
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	return w.WriteStatusLineWithReason(statusCode, StatusText(statusCode))
+}
+
+// WriteStatusLineWithReason writes the final status line with a custom reason
+// phrase. 1xx codes are rejected here, use WriteInterimResponse for those.
+func (w *Writer) WriteStatusLineWithReason(statusCode StatusCode, reason string) error {
 	if w.state != writerStateStatusLine {
 		return fmt.Errorf("status line must be written first")
 	}
-	if err := WriteStatusLine(w.writer, statusCode); err != nil {
+	if statusCode.IsInformational() {
+		return fmt.Errorf("status %d can only be sent as an interim response", statusCode)
+	}
+	if err := WriteStatusLineWithReason(w.writer, statusCode, reason); err != nil {
 		return err
 	}
+	w.status = statusCode
 	w.state = writerStateHeaders
 	return nil
 }
 
+// WriteInterimResponse writes a 1xx response ahead of the final one. It can be
+// called any number of times until the final status line is written.
+func (w *Writer) WriteInterimResponse(statusCode StatusCode, headers Headers) error {
+	if w.state != writerStateStatusLine {
+		return fmt.Errorf("interim responses must precede the final status line")
+	}
+	if !statusCode.IsInformational() {
+		return fmt.Errorf("interim response requires a 1xx status code, got %d", statusCode)
+	}
+	if err := WriteStatusLine(w.writer, statusCode); err != nil {
+		return err
+	}
+	return WriteHeaders(w.writer, headers)
+}
+
 func (w *Writer) WriteHeaders(headers Headers) error {
 	if w.state != writerStateHeaders {
 		return fmt.Errorf("headers must be written after status line")
 	}
-	if err := WriteHeaders(w.writer, headers); err != nil {
+	headers = w.runHeaderHooks(headers)
+	chunked := headers.HasToken("transfer-encoding", "chunked")
+	contentLength := int64(-1)
+	if !chunked && headers.Has("content-length") {
+		n, err := strconv.ParseInt(headers.Get("content-length"), 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid Content-Length: %q", headers.Get("content-length"))
+		}
+		contentLength = n
+	}
+	if headers.HasToken("connection", "close") {
+		w.closeConn = true
+	}
+	if w.http10 {
+		if headers.HasToken("transfer-encoding", "chunked") {
+			w.unchunked = true
+			w.closeConn = true
+		} else if !headers.Has("content-length") {
+			w.closeConn = true
+		}
+	}
+	sent := w.connectionHeaders(headers)
+	if err := WriteHeaders(w.writer, sent); err != nil {
 		return err
 	}
+	w.sent = sent
+	w.chunked = chunked
+	w.contentLength = contentLength
 	w.state = writerStateBody
 	return nil
 }
 
+// SetRequestVersion tells the writer which HTTP version the client speaks.
+// HTTP/1.0 clients can't decode chunked bodies, so chunked writes fall back to
+// a close-delimited body, and a persistent connection is announced with
+// "Connection: keep-alive".
+func (w *Writer) SetRequestVersion(version string) {
+	w.http10 = version == "1.0"
+}
+
+// SetRequestMethod tells the writer which method the response answers. For
+// HEAD the writer sends the status line and headers the handler produces,
+// including Content-Length, but drops every body byte and chunk.
+func (w *Writer) SetRequestMethod(method string) {
+	w.method = method
+	w.head = method == "HEAD"
+}
+
+// IsHead reports whether the body of this response is discarded because it
+// answers a HEAD request. Handlers can use it to skip producing the body.
+func (w *Writer) IsHead() bool {
+	return w.head
+}
+
+// CloseAfterResponse makes the writer announce "Connection: close" and marks
+// the connection as not reusable once the response is written.
+func (w *Writer) CloseAfterResponse() {
+	w.closeConn = true
+}
+
+// ShouldClose reports whether the connection must be closed after this
+// response, either because one side asked for it or because the response was
+// not written completely, including a body shorter than its Content-Length.
+func (w *Writer) ShouldClose() bool {
+	if w.closeConn || w.state != writerStateDone {
+		return true
+	}
+	return !w.dropsBody() && w.contentLength >= 0 && w.written != w.contentLength
+}
+
+// BytesWritten returns the number of body bytes written so far, not counting
+// chunked framing.
+func (w *Writer) BytesWritten() int64 {
+	return w.written
+}
+
+// dropsBody reports whether body bytes and chunk framing are dropped, for
+// HEAD and for statuses that can't carry a body, such as 204 and 304.
+func (w *Writer) dropsBody() bool {
+	return w.head || !w.status.AllowsBody()
+}
+
+// writePayload writes body bytes, refusing to go past the declared
+// Content-Length.
+func (w *Writer) writePayload(p []byte) (int, error) {
+	if w.dropsBody() {
+		return len(p), nil
+	}
+	if w.contentLength >= 0 && w.written+int64(len(p)) > w.contentLength {
+		return 0, ErrContentLengthExceeded
+	}
+	n, err := w.writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *Writer) connectionHeaders(headers Headers) Headers {
+	if !w.closeConn && !w.http10 {
+		return headers
+	}
+	h := headers.Clone()
+	if w.unchunked {
+		h.Del("Transfer-Encoding")
+		h.Del("Trailer")
+	}
+	if w.closeConn {
+		h.Set("Connection", "close")
+	} else {
+		h.Set("Connection", "keep-alive")
+	}
+	return h
+}
+
 func (w *Writer) WriteBody(p []byte) (int, error) {
 	if w.state != writerStateBody {
 		return 0, fmt.Errorf("body must be written after status line and headers")
 	}
-	n, err := w.writer.Write(p)
+	if w.body != nil {
+		n, err := w.body.Write(p)
+		if err != nil {
+			return n, err
+		}
+		if err := w.closeWrappers(); err != nil {
+			return n, err
+		}
+		w.state = writerStateDone
+		return n, nil
+	}
+	n, err := w.writePayload(p)
 	if err != nil {
 		return n, err
 	}
@@ -73,63 +238,55 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 }
 
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	reasonPhrase := statusReasonPhrase(statusCode)
-	var line string
-	if reasonPhrase == "" {
-		line = fmt.Sprintf("HTTP/1.1 %d\r\n", statusCode)
-	} else {
-		line = fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase)
-	}
-	_, err := io.WriteString(w, line)
-	return err
+	return WriteStatusLineWithReason(w, statusCode, StatusText(statusCode))
 }
 
-func statusReasonPhrase(statusCode StatusCode) string {
-	switch statusCode {
-	case StatusOK:
-		return "OK"
-	case StatusBadRequest:
-		return "Bad Request"
-	case StatusInternalServerError:
-		return "Internal Server Error"
-	default:
-		return ""
+func WriteStatusLineWithReason(w io.Writer, statusCode StatusCode, reason string) error {
+	if err := validateStatusCode(statusCode); err != nil {
+		return err
+	}
+	if !validReasonPhrase(reason) {
+		return fmt.Errorf("invalid reason phrase: %q", reason)
 	}
+	line := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, reason)
+	_, err := io.WriteString(w, line)
+	return err
 }
 
 func GetDefaultHeaders(contentLen int) Headers {
 	return Headers{
-		"content-length": fmt.Sprintf("%d", contentLen),
-		"connection":     "close",
-		"content-type":   "text/plain",
+		{Name: "Content-Length", Value: fmt.Sprintf("%d", contentLen)},
+		{Name: "Content-Type", Value: "text/plain"},
 	}
 }
 
 func WriteHeaders(w io.Writer, headers Headers) error {
-	for key, value := range headers {
-		headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
-		_, err := io.WriteString(w, headerLine)
-		if err != nil {
-			return fmt.Errorf("failed to write header %s: %w", key, err)
-		}
-	}
-	_, err := io.WriteString(w, "\r\n")
-	if err != nil {
-		return fmt.Errorf("failed to write headers terminator: %w", err)
-	}
-	return nil
+	return headers.Write(w)
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.state != writerStateBody {
 		return 0, fmt.Errorf("body must be written after status line and headers")
 	}
+	if w.body != nil {
+		return w.body.Write(p)
+	}
+	return w.writeChunk(p)
+}
+
+func (w *Writer) writeChunk(p []byte) (int, error) {
+	if w.unchunked || w.dropsBody() {
+		return w.writePayload(p)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
 	sizeLine := fmt.Sprintf("%x\r\n", len(p))
 	_, err := io.WriteString(w.writer, sizeLine)
 	if err != nil {
 		return 0, err
 	}
-	n, err := w.writer.Write(p)
+	n, err := w.writePayload(p)
 	if err != nil {
 		return n, err
 	}
@@ -144,6 +301,13 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	if w.state != writerStateBody {
 		return 0, fmt.Errorf("body must be written after status line and headers")
 	}
+	if err := w.closeWrappers(); err != nil {
+		return 0, err
+	}
+	if w.unchunked || w.dropsBody() {
+		w.state = writerStateDone
+		return 0, nil
+	}
 	n, err := io.WriteString(w.writer, "0\r\n\r\n")
 	if err != nil {
 		return n, err
@@ -156,6 +320,13 @@ func (w *Writer) WriteTrailers(h Headers) error {
 	if w.state != writerStateBody {
 		return fmt.Errorf("body must be written after status line and headers")
 	}
+	if err := w.closeWrappers(); err != nil {
+		return err
+	}
+	if w.unchunked || w.dropsBody() {
+		w.state = writerStateDone
+		return nil
+	}
 	if _, err := io.WriteString(w.writer, "0\r\n"); err != nil {
 		return err
 	}
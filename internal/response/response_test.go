@@ -2,8 +2,16 @@ package response
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/glebson1988/httpfromtcp/internal/headers"
 )
 
 func TestChunkedBodyWrites(t *testing.T) {
@@ -13,7 +21,7 @@ func TestChunkedBodyWrites(t *testing.T) {
 		if err := writer.WriteStatusLine(StatusOK); err != nil {
 			t.Fatalf("WriteStatusLine error: %v", err)
 		}
-		if err := writer.WriteHeaders(Headers{"transfer-encoding": "chunked"}); err != nil {
+		if err := writer.WriteHeaders(Headers{{Name: "transfer-encoding", Value: "chunked"}}); err != nil {
 			t.Fatalf("WriteHeaders error: %v", err)
 		}
 
@@ -49,7 +57,7 @@ func TestChunkedBodyWrites(t *testing.T) {
 		if err := writer.WriteStatusLine(StatusOK); err != nil {
 			t.Fatalf("WriteStatusLine error: %v", err)
 		}
-		if err := writer.WriteHeaders(Headers{"transfer-encoding": "chunked"}); err != nil {
+		if err := writer.WriteHeaders(Headers{{Name: "transfer-encoding", Value: "chunked"}}); err != nil {
 			t.Fatalf("WriteHeaders error: %v", err)
 		}
 		if _, err := writer.WriteChunkedBody([]byte("hello")); err != nil {
@@ -57,8 +65,8 @@ func TestChunkedBodyWrites(t *testing.T) {
 		}
 
 		trailers := Headers{
-			"x-content-sha256": "deadbeef",
-			"x-content-length": "5",
+			{Name: "x-content-sha256", Value: "deadbeef"},
+			{Name: "x-content-length", Value: "5"},
 		}
 		if err := writer.WriteTrailers(trailers); err != nil {
 			t.Fatalf("WriteTrailers error: %v", err)
@@ -86,3 +94,1043 @@ func TestChunkedBodyWrites(t *testing.T) {
 		}
 	})
 }
+
+func TestHTTP10Responses(t *testing.T) {
+	t.Run("falls back to close-delimited body", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.SetRequestVersion("1.0")
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		headers := Headers{
+			{Name: "Transfer-Encoding", Value: "chunked"},
+			{Name: "Trailer", Value: "X-Checksum"},
+		}
+		if err := writer.WriteHeaders(headers); err != nil {
+			t.Fatalf("WriteHeaders error: %v", err)
+		}
+		if _, err := writer.WriteChunkedBody([]byte("hello")); err != nil {
+			t.Fatalf("WriteChunkedBody error: %v", err)
+		}
+		if err := writer.WriteTrailers(Headers{{Name: "X-Checksum", Value: "abc"}}); err != nil {
+			t.Fatalf("WriteTrailers error: %v", err)
+		}
+
+		if buf.String() != "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello" {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+		if headers.Get("transfer-encoding") != "chunked" {
+			t.Fatalf("caller headers were modified")
+		}
+		if !writer.ShouldClose() {
+			t.Fatalf("expected connection to be closed")
+		}
+	})
+
+	t.Run("announces keep-alive with Content-Length", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.SetRequestVersion("1.0")
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		if err := writer.WriteHeaders(Headers{{Name: "Content-Length", Value: "2"}}); err != nil {
+			t.Fatalf("WriteHeaders error: %v", err)
+		}
+		if _, err := writer.WriteBody([]byte("ok")); err != nil {
+			t.Fatalf("WriteBody error: %v", err)
+		}
+
+		if !strings.Contains(buf.String(), "Connection: keep-alive\r\n") {
+			t.Fatalf("missing keep-alive header: %q", buf.String())
+		}
+		if writer.ShouldClose() {
+			t.Fatalf("expected connection to stay open")
+		}
+	})
+
+	t.Run("closes without Content-Length", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.SetRequestVersion("1.0")
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		if err := writer.WriteHeaders(Headers{}); err != nil {
+			t.Fatalf("WriteHeaders error: %v", err)
+		}
+		if _, err := writer.WriteBody([]byte("ok")); err != nil {
+			t.Fatalf("WriteBody error: %v", err)
+		}
+		if !writer.ShouldClose() {
+			t.Fatalf("expected connection to be closed")
+		}
+	})
+}
+
+func TestInterimResponses(t *testing.T) {
+	t.Run("writes 1xx before the final response", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		if err := writer.WriteInterimResponse(StatusContinue, nil); err != nil {
+			t.Fatalf("WriteInterimResponse error: %v", err)
+		}
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		if err := writer.WriteHeaders(Headers{}); err != nil {
+			t.Fatalf("WriteHeaders error: %v", err)
+		}
+		if buf.String() != "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\n\r\n" {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+	})
+
+	t.Run("rejects non-1xx codes", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		if err := writer.WriteInterimResponse(StatusOK, nil); err == nil {
+			t.Fatalf("expected error for 200")
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("unexpected bytes written: %q", buf.String())
+		}
+	})
+
+	t.Run("rejects interim after final status line", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		if err := writer.WriteInterimResponse(StatusContinue, nil); err == nil {
+			t.Fatalf("expected error after final status line")
+		}
+	})
+}
+
+func TestWriteHeaders(t *testing.T) {
+	t.Run("rejects unsafe fields before writing", func(t *testing.T) {
+		for _, headers := range []Headers{
+			{{Name: "X-Ok", Value: "1"}, {Name: "X-Evil", Value: "a\r\nSet-Cookie: admin=1"}},
+			{{Name: "X-Ok", Value: "1"}, {Name: "X-Evil", Value: "a\nb"}},
+			{{Name: "X-Ok", Value: "1"}, {Name: "X-Evil", Value: "a\x00b"}},
+			{{Name: "X-Ok", Value: "1"}, {Name: "X-Evil: 1\r\nX", Value: "b"}},
+		} {
+			var buf bytes.Buffer
+			if err := WriteHeaders(&buf, headers); err == nil {
+				t.Fatalf("expected error for %q", headers)
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("unexpected bytes written: %q", buf.String())
+			}
+		}
+	})
+
+	t.Run("writer stays in header state after rejection", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		if err := writer.WriteHeaders(Headers{{Name: "X-Evil", Value: "a\r\n\r\n<html>"}}); err == nil {
+			t.Fatalf("expected error for injected value")
+		}
+		if err := writer.WriteHeaders(Headers{{Name: "X-Ok", Value: "1"}}); err != nil {
+			t.Fatalf("WriteHeaders error: %v", err)
+		}
+		if buf.String() != "HTTP/1.1 200 OK\r\nX-Ok: 1\r\n\r\n" {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+	})
+
+	t.Run("writes fields in order with original case", func(t *testing.T) {
+		var buf bytes.Buffer
+		headers := Headers{
+			{Name: "Content-Type", Value: "text/html"},
+			{Name: "Set-Cookie", Value: "a=1"},
+			{Name: "Set-Cookie", Value: "b=2"},
+			{Name: "X-Request-ID", Value: "42"},
+		}
+		if err := WriteHeaders(&buf, headers); err != nil {
+			t.Fatalf("WriteHeaders error: %v", err)
+		}
+		want := "Content-Type: text/html\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\nX-Request-ID: 42\r\n\r\n"
+		if buf.String() != want {
+			t.Fatalf("unexpected headers: %q", buf.String())
+		}
+	})
+}
+
+func TestStatusLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   StatusCode
+		reason *string
+		want   string
+	}{
+		{name: "registered code", code: StatusNotFound, want: "HTTP/1.1 404 Not Found\r\n"},
+		{name: "redirect", code: StatusFound, want: "HTTP/1.1 302 Found\r\n"},
+		{name: "unregistered code", code: 599, want: "HTTP/1.1 599 \r\n"},
+		{name: "custom reason", code: StatusOK, reason: ptr("Everything Is Fine"), want: "HTTP/1.1 200 Everything Is Fine\r\n"},
+		{name: "empty custom reason", code: StatusNoContent, reason: ptr(""), want: "HTTP/1.1 204 \r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer := NewWriter(&buf)
+			var err error
+			if tt.reason != nil {
+				err = writer.WriteStatusLineWithReason(tt.code, *tt.reason)
+			} else {
+				err = writer.WriteStatusLine(tt.code)
+			}
+			if err != nil {
+				t.Fatalf("WriteStatusLine error: %v", err)
+			}
+			if buf.String() != tt.want {
+				t.Fatalf("unexpected status line: %q", buf.String())
+			}
+		})
+	}
+
+	t.Run("rejects codes that are not three digits", func(t *testing.T) {
+		for _, code := range []StatusCode{0, 99, 1000, -200} {
+			var buf bytes.Buffer
+			if err := NewWriter(&buf).WriteStatusLine(code); err == nil {
+				t.Fatalf("expected error for %d", code)
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("unexpected bytes written: %q", buf.String())
+			}
+		}
+	})
+
+	t.Run("rejects 1xx as final status", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		if err := writer.WriteStatusLine(StatusContinue); err == nil {
+			t.Fatalf("expected error for 100 as final status")
+		}
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+	})
+
+	t.Run("rejects reason phrases with control characters", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := NewWriter(&buf).WriteStatusLineWithReason(StatusOK, "OK\r\nSet-Cookie: a=1"); err == nil {
+			t.Fatalf("expected error for injected reason phrase")
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("unexpected bytes written: %q", buf.String())
+		}
+	})
+
+	t.Run("StatusText", func(t *testing.T) {
+		if got := StatusText(StatusTooManyRequests); got != "Too Many Requests" {
+			t.Fatalf("unexpected text: %q", got)
+		}
+		if got := StatusText(StatusNetworkAuthenticationRequired); got != "Network Authentication Required" {
+			t.Fatalf("unexpected text: %q", got)
+		}
+		if got := StatusText(418); got != "" {
+			t.Fatalf("unexpected text for unregistered code: %q", got)
+		}
+	})
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestAutoFraming(t *testing.T) {
+	t.Run("buffers small bodies with Content-Length", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.Header().Set("Content-Type", "text/plain")
+		if _, err := writer.Write([]byte("hello ")); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		if _, err := writer.Write([]byte("world")); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("expected body to be buffered, got %q", buf.String())
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		want := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 11\r\n\r\nhello world"
+		if buf.String() != want {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+		if writer.ShouldClose() {
+			t.Fatalf("expected connection to stay open")
+		}
+	})
+
+	t.Run("switches to chunked for large bodies", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.SetStatus(StatusCreated)
+		big := strings.Repeat("x", maxBufferedBody+1)
+		if _, err := writer.Write([]byte(big)); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		if _, err := writer.Write([]byte("tail")); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		want := "HTTP/1.1 201 Created\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			fmt.Sprintf("%x\r\n%s\r\n", len(big), big) +
+			"4\r\ntail\r\n0\r\n\r\n"
+		if buf.String() != want {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+	})
+
+	t.Run("Flush commits to chunked", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		if _, err := writer.Write([]byte("event: 1\n")); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatalf("Flush error: %v", err)
+		}
+		if !strings.HasSuffix(buf.String(), "9\r\nevent: 1\n\r\n") {
+			t.Fatalf("expected flushed chunk, got %q", buf.String())
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		if !strings.HasSuffix(buf.String(), "0\r\n\r\n") {
+			t.Fatalf("missing last chunk: %q", buf.String())
+		}
+	})
+
+	t.Run("writes default 200 when nothing was written", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		if buf.String() != "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n" {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+	})
+
+	t.Run("keeps a handler-declared Content-Length", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.Header().Set("Content-Length", "5000")
+		body := strings.Repeat("y", 5000)
+		if _, err := writer.Write([]byte(body)); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		if buf.String() != "HTTP/1.1 200 OK\r\nContent-Length: 5000\r\n\r\n"+body {
+			t.Fatalf("unexpected response: %q", buf.String()[:60])
+		}
+	})
+
+	t.Run("sends no body for 204", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.SetStatus(StatusNoContent)
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		if buf.String() != "HTTP/1.1 204 No Content\r\n\r\n" {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+	})
+
+	t.Run("writes body in pieces after WriteHeaders", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		if err := writer.WriteHeaders(GetDefaultHeaders(10)); err != nil {
+			t.Fatalf("WriteHeaders error: %v", err)
+		}
+		for _, piece := range []string{"01234", "56789"} {
+			if _, err := writer.Write([]byte(piece)); err != nil {
+				t.Fatalf("Write error: %v", err)
+			}
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		if !strings.HasSuffix(buf.String(), "\r\n\r\n0123456789") {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+		if _, err := writer.Write([]byte("more")); err == nil {
+			t.Fatalf("expected error writing after Finish")
+		}
+	})
+
+	t.Run("HTTP/1.0 large bodies are close-delimited", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.SetRequestVersion("1.0")
+		big := strings.Repeat("z", maxBufferedBody+1)
+		if _, err := writer.Write([]byte(big)); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		if buf.String() != "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n"+big {
+			t.Fatalf("unexpected response head: %q", buf.String()[:60])
+		}
+		if !writer.ShouldClose() {
+			t.Fatalf("expected connection to be closed")
+		}
+	})
+}
+
+func TestContentLengthEnforcement(t *testing.T) {
+	newBodyWriter := func(t *testing.T, buf *bytes.Buffer, contentLength int) *Writer {
+		t.Helper()
+		writer := NewWriter(buf)
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		if err := writer.WriteHeaders(GetDefaultHeaders(contentLength)); err != nil {
+			t.Fatalf("WriteHeaders error: %v", err)
+		}
+		return writer
+	}
+
+	t.Run("rejects writes past Content-Length", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := newBodyWriter(t, &buf, 10)
+		if _, err := writer.Write([]byte("012345")); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		before := buf.Len()
+		if _, err := writer.Write([]byte("6789X")); !errors.Is(err, ErrContentLengthExceeded) {
+			t.Fatalf("expected ErrContentLengthExceeded, got %v", err)
+		}
+		if buf.Len() != before {
+			t.Fatalf("unexpected bytes written: %q", buf.String()[before:])
+		}
+		if writer.BytesWritten() != 6 {
+			t.Fatalf("unexpected BytesWritten: %d", writer.BytesWritten())
+		}
+	})
+
+	t.Run("rejects buffered writes past a Content-Length set in Header", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.Header().Set("Content-Length", "3")
+		if _, err := io.WriteString(writer, "ab"); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		if _, err := io.WriteString(writer, "cd"); !errors.Is(err, ErrContentLengthExceeded) {
+			t.Fatalf("expected ErrContentLengthExceeded, got %v", err)
+		}
+		if _, err := io.WriteString(writer, "c"); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		if !strings.HasSuffix(buf.String(), "Content-Length: 3\r\n\r\nabc") || writer.ShouldClose() {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+	})
+
+	t.Run("WriteBody rejects a body longer than declared", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := newBodyWriter(t, &buf, 3)
+		if _, err := writer.WriteBody([]byte("toolong")); !errors.Is(err, ErrContentLengthExceeded) {
+			t.Fatalf("expected ErrContentLengthExceeded, got %v", err)
+		}
+	})
+
+	t.Run("short body closes the connection", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := newBodyWriter(t, &buf, 100)
+		if _, err := writer.WriteBody(make([]byte, 80)); err != nil {
+			t.Fatalf("WriteBody error: %v", err)
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		if !writer.ShouldClose() {
+			t.Fatalf("expected short response to close the connection")
+		}
+		if writer.BytesWritten() != 80 {
+			t.Fatalf("unexpected BytesWritten: %d", writer.BytesWritten())
+		}
+	})
+
+	t.Run("exact body keeps the connection", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := newBodyWriter(t, &buf, 10)
+		for _, piece := range []string{"0123", "456789"} {
+			if _, err := writer.Write([]byte(piece)); err != nil {
+				t.Fatalf("Write error: %v", err)
+			}
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		if writer.ShouldClose() {
+			t.Fatalf("expected connection to stay open")
+		}
+	})
+
+	t.Run("rejects an invalid Content-Length header", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		if err := writer.WriteHeaders(Headers{{Name: "Content-Length", Value: "-1"}}); err == nil {
+			t.Fatalf("expected error for negative Content-Length")
+		}
+	})
+
+	t.Run("counts chunked payload without framing", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		if err := writer.WriteHeaders(Headers{{Name: "Transfer-Encoding", Value: "chunked"}}); err != nil {
+			t.Fatalf("WriteHeaders error: %v", err)
+		}
+		for _, piece := range []string{"hello", "world!"} {
+			if _, err := writer.WriteChunkedBody([]byte(piece)); err != nil {
+				t.Fatalf("WriteChunkedBody error: %v", err)
+			}
+		}
+		if writer.BytesWritten() != 11 {
+			t.Fatalf("unexpected BytesWritten: %d", writer.BytesWritten())
+		}
+	})
+}
+
+func TestHeadResponses(t *testing.T) {
+	t.Run("keeps Content-Length but drops the body", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.SetRequestMethod("HEAD")
+		if !writer.IsHead() {
+			t.Fatalf("expected IsHead to be true")
+		}
+		writer.Header().Set("Content-Type", "text/plain")
+		if n, err := writer.Write([]byte("hello world")); err != nil || n != 11 {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		want := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 11\r\n\r\n"
+		if buf.String() != want {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+		if writer.ShouldClose() {
+			t.Fatalf("expected connection to stay open")
+		}
+		if writer.BytesWritten() != 0 {
+			t.Fatalf("unexpected BytesWritten: %d", writer.BytesWritten())
+		}
+	})
+
+	t.Run("drops chunked framing and trailers", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.SetRequestMethod("HEAD")
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		if err := writer.WriteHeaders(Headers{{Name: "Transfer-Encoding", Value: "chunked"}}); err != nil {
+			t.Fatalf("WriteHeaders error: %v", err)
+		}
+		if _, err := writer.WriteChunkedBody([]byte("hello")); err != nil {
+			t.Fatalf("WriteChunkedBody error: %v", err)
+		}
+		if err := writer.WriteTrailers(Headers{{Name: "X-Checksum", Value: "abc"}}); err != nil {
+			t.Fatalf("WriteTrailers error: %v", err)
+		}
+		if buf.String() != "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" {
+			t.Fatalf("unexpected response: %q", buf.String())
+		}
+		if writer.ShouldClose() {
+			t.Fatalf("expected connection to stay open")
+		}
+	})
+
+	t.Run("explicit Content-Length with no body written", func(t *testing.T) {
+		var buf bytes.Buffer
+		writer := NewWriter(&buf)
+		writer.SetRequestMethod("HEAD")
+		if err := writer.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		if err := writer.WriteHeaders(GetDefaultHeaders(1 << 20)); err != nil {
+			t.Fatalf("WriteHeaders error: %v", err)
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Finish error: %v", err)
+		}
+		if writer.ShouldClose() {
+			t.Fatalf("expected connection to stay open")
+		}
+	})
+}
+
+func TestNoBodyStatuses(t *testing.T) {
+	for _, status := range []StatusCode{StatusNoContent, StatusNotModified} {
+		t.Run(fmt.Sprintf("%d drops chunked framing and trailers", status), func(t *testing.T) {
+			var buf bytes.Buffer
+			writer := NewWriter(&buf)
+			if err := writer.WriteStatusLine(status); err != nil {
+				t.Fatalf("WriteStatusLine error: %v", err)
+			}
+			if err := writer.WriteHeaders(Headers{{Name: "Transfer-Encoding", Value: "chunked"}}); err != nil {
+				t.Fatalf("WriteHeaders error: %v", err)
+			}
+			if _, err := writer.WriteChunkedBody([]byte("hello")); err != nil {
+				t.Fatalf("WriteChunkedBody error: %v", err)
+			}
+			if err := writer.WriteTrailers(Headers{{Name: "X-Checksum", Value: "abc"}}); err != nil {
+				t.Fatalf("WriteTrailers error: %v", err)
+			}
+			want := fmt.Sprintf("HTTP/1.1 %d %s\r\nTransfer-Encoding: chunked\r\n\r\n", status, StatusText(status))
+			if buf.String() != want {
+				t.Fatalf("unexpected response: %q", buf.String())
+			}
+			if writer.ShouldClose() {
+				t.Fatalf("expected connection to stay open")
+			}
+		})
+
+		t.Run(fmt.Sprintf("%d drops a written body", status), func(t *testing.T) {
+			var buf bytes.Buffer
+			writer := NewWriter(&buf)
+			if err := writer.WriteStatusLine(status); err != nil {
+				t.Fatalf("WriteStatusLine error: %v", err)
+			}
+			if err := writer.WriteHeaders(Headers{{Name: "ETag", Value: `"v1"`}}); err != nil {
+				t.Fatalf("WriteHeaders error: %v", err)
+			}
+			if n, err := writer.Write([]byte("hello")); err != nil || n != 5 {
+				t.Fatalf("Write = %d, %v", n, err)
+			}
+			if err := writer.Finish(); err != nil {
+				t.Fatalf("Finish error: %v", err)
+			}
+			want := fmt.Sprintf("HTTP/1.1 %d %s\r\nETag: \"v1\"\r\n\r\n", status, StatusText(status))
+			if buf.String() != want {
+				t.Fatalf("unexpected response: %q", buf.String())
+			}
+		})
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	modified := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	before := headers.FormatTime(modified.Add(-time.Hour))
+	after := headers.FormatTime(modified.Add(time.Hour))
+	exact := headers.FormatTime(modified)
+
+	tests := []struct {
+		name       string
+		method     string
+		request    Headers
+		etag       string
+		weak       bool
+		noModTime  bool
+		status     StatusCode
+		wantStatus StatusCode
+	}{
+		{name: "no conditions", method: "GET", etag: "v1", wantStatus: StatusOK},
+		{name: "If-None-Match matches", method: "GET", etag: "v1", request: Headers{{Name: "If-None-Match", Value: `"v0", "v1"`}}, wantStatus: StatusNotModified},
+		{name: "If-None-Match matches weakly", method: "GET", etag: "v1", weak: true, request: Headers{{Name: "If-None-Match", Value: `"v1"`}}, wantStatus: StatusNotModified},
+		{name: "If-None-Match differs", method: "GET", etag: "v1", request: Headers{{Name: "If-None-Match", Value: `"v2"`}}, wantStatus: StatusOK},
+		{name: "If-None-Match star", method: "HEAD", etag: "v1", request: Headers{{Name: "If-None-Match", Value: "*"}}, wantStatus: StatusNotModified},
+		{name: "If-None-Match on unsafe method", method: "PUT", etag: "v1", request: Headers{{Name: "If-None-Match", Value: `"v1"`}}, wantStatus: StatusPreconditionFailed},
+		{name: "If-None-Match beats If-Modified-Since", method: "GET", etag: "v1", request: Headers{{Name: "If-None-Match", Value: `"v2"`}, {Name: "If-Modified-Since", Value: after}}, wantStatus: StatusOK},
+		{name: "If-Match matches", method: "PUT", etag: "v1", request: Headers{{Name: "If-Match", Value: `"v1"`}}, wantStatus: StatusOK},
+		{name: "If-Match with comma in tag", method: "PUT", etag: "a,b", request: Headers{{Name: "If-Match", Value: `"x", "a,b"`}}, wantStatus: StatusOK},
+		{name: "If-Match differs", method: "PUT", etag: "v1", request: Headers{{Name: "If-Match", Value: `"v2"`}}, wantStatus: StatusPreconditionFailed},
+		{name: "If-Match needs a strong tag", method: "PUT", etag: "v1", weak: true, request: Headers{{Name: "If-Match", Value: `W/"v1"`}}, wantStatus: StatusPreconditionFailed},
+		{name: "If-Match beats If-Unmodified-Since", method: "PUT", etag: "v1", request: Headers{{Name: "If-Match", Value: `"v1"`}, {Name: "If-Unmodified-Since", Value: before}}, wantStatus: StatusOK},
+		{name: "If-Match checked before If-None-Match", method: "GET", etag: "v1", request: Headers{{Name: "If-Match", Value: `"v2"`}, {Name: "If-None-Match", Value: `"v1"`}}, wantStatus: StatusPreconditionFailed},
+		{name: "If-Unmodified-Since passes", method: "DELETE", request: Headers{{Name: "If-Unmodified-Since", Value: exact}}, wantStatus: StatusOK},
+		{name: "If-Unmodified-Since fails", method: "DELETE", request: Headers{{Name: "If-Unmodified-Since", Value: before}}, wantStatus: StatusPreconditionFailed},
+		{name: "If-Unmodified-Since without a date", method: "DELETE", noModTime: true, request: Headers{{Name: "If-Unmodified-Since", Value: before}}, wantStatus: StatusOK},
+		{name: "If-Modified-Since not modified", method: "GET", request: Headers{{Name: "If-Modified-Since", Value: exact}}, wantStatus: StatusNotModified},
+		{name: "If-Modified-Since modified", method: "GET", request: Headers{{Name: "If-Modified-Since", Value: before}}, wantStatus: StatusOK},
+		{name: "If-Modified-Since invalid date", method: "GET", request: Headers{{Name: "If-Modified-Since", Value: "yesterday"}}, wantStatus: StatusOK},
+		{name: "If-Modified-Since ignored for POST", method: "POST", request: Headers{{Name: "If-Modified-Since", Value: exact}}, wantStatus: StatusOK},
+		{name: "conditions ignored for errors", method: "GET", etag: "v1", status: StatusNotFound, request: Headers{{Name: "If-None-Match", Value: "*"}}, wantStatus: StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			w.SetRequestMethod(tt.method)
+			w.SetRequestHeaders(tt.request)
+			if tt.etag != "" {
+				if err := w.SetETag(tt.etag, tt.weak); err != nil {
+					t.Fatalf("SetETag returned error: %v", err)
+				}
+			}
+			if !tt.noModTime {
+				w.SetLastModified(modified)
+			}
+			if tt.status != 0 {
+				w.SetStatus(tt.status)
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = io.WriteString(w, "representation")
+			if err := w.Finish(); err != nil {
+				t.Fatalf("Finish returned error: %v", err)
+			}
+
+			resp, err := ResponseFromReader(&buf, tt.method)
+			if err != nil {
+				t.Fatalf("parsing response: %v", err)
+			}
+			if resp.StatusLine.StatusCode != tt.wantStatus {
+				t.Fatalf("unexpected status: %d", resp.StatusLine.StatusCode)
+			}
+			if tt.wantStatus == StatusNotModified {
+				if resp.Headers.Has("Content-Type") || len(resp.Body) != 0 {
+					t.Fatalf("304 carried content: %v %q", resp.Headers, resp.Body)
+				}
+				if tt.etag != "" && resp.Headers.Get("ETag") == "" {
+					t.Fatalf("304 lost the ETag: %v", resp.Headers)
+				}
+			}
+			if w.ShouldClose() {
+				t.Fatalf("expected the connection to stay open")
+			}
+		})
+	}
+}
+
+func TestComputeETag(t *testing.T) {
+	write := func(body string, request Headers) *Response {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.SetRequestMethod("GET")
+		w.SetRequestHeaders(request)
+		w.ComputeETag()
+		_, _ = io.WriteString(w, body)
+		if err := w.Finish(); err != nil {
+			t.Fatalf("Finish returned error: %v", err)
+		}
+		resp, err := ResponseFromReader(&buf, "GET")
+		if err != nil {
+			t.Fatalf("parsing response: %v", err)
+		}
+		return resp
+	}
+
+	first := write("hello", nil)
+	etag := first.Headers.Get("ETag")
+	if !strings.HasPrefix(etag, `"`) || etag != write("hello", nil).Headers.Get("ETag") {
+		t.Fatalf("expected a stable strong ETag, got %q", etag)
+	}
+	if etag == write("other", nil).Headers.Get("ETag") {
+		t.Fatalf("different bodies got the same ETag")
+	}
+	if resp := write("hello", Headers{{Name: "If-None-Match", Value: etag}}); resp.StatusLine.StatusCode != StatusNotModified {
+		t.Fatalf("unexpected status: %d", resp.StatusLine.StatusCode)
+	}
+
+	// A body too large to buffer is streamed without an ETag.
+	large := write(strings.Repeat("x", maxBufferedBody+1), nil)
+	if large.Headers.Has("ETag") || large.StatusLine.StatusCode != StatusOK {
+		t.Fatalf("unexpected response for a large body: %v", large.Headers)
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetRequestMethod("GET")
+	w.SetRequestHeaders(Headers{{Name: "If-None-Match", Value: `"v1"`}})
+	if err := w.SetETag("v1", false); err != nil {
+		t.Fatalf("SetETag returned error: %v", err)
+	}
+	if w.CheckPreconditions() {
+		t.Fatalf("expected the precondition to fail")
+	}
+	if w.CheckPreconditions() {
+		t.Fatalf("expected the result to be remembered")
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatalf("Finish returned error: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "HTTP/1.1 304 Not Modified\r\n") {
+		t.Fatalf("unexpected response: %q", buf.String())
+	}
+
+	if err := NewWriter(io.Discard).SetETag(`bad"tag`, false); err == nil {
+		t.Fatalf("expected an error for an invalid entity-tag")
+	}
+}
+
+// gzipBody compresses the body of w and marks it with Content-Encoding.
+func gzipBody(t *testing.T, w *Writer) {
+	t.Helper()
+
+	if err := w.WrapBody(func(next io.Writer) io.WriteCloser {
+		return gzip.NewWriter(next)
+	}); err != nil {
+		t.Fatalf("WrapBody returned error: %v", err)
+	}
+	w.OnHeaders(func(statusCode StatusCode, h *Headers) {
+		if statusCode == StatusOK {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", "gzip")
+		}
+	})
+}
+
+// noisyText returns n bytes of text that gzip can't shrink much.
+func noisyText(n int) string {
+	rng := rand.New(rand.NewPCG(1, 2))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('!' + rng.IntN(94))
+	}
+	return string(b)
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	t.Helper()
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("reading gzip body: %v", err)
+	}
+	return string(plain)
+}
+
+func TestWrapBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantFraming string
+	}{
+		{"small body keeps a Content-Length", "hello, hello, hello", "content-length"},
+		{"large body switches to chunked", noisyText(16 << 10), "chunked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			gzipBody(t, w)
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", fmt.Sprint(len(tt.body)))
+			for i := 0; i < len(tt.body); i += 1000 {
+				if _, err := io.WriteString(w, tt.body[i:min(i+1000, len(tt.body))]); err != nil {
+					t.Fatalf("Write returned error: %v", err)
+				}
+			}
+			if err := w.Finish(); err != nil {
+				t.Fatalf("Finish returned error: %v", err)
+			}
+
+			resp, err := ResponseFromReader(&buf, "GET")
+			if err != nil {
+				t.Fatalf("parsing response: %v", err)
+			}
+			if resp.Headers.Get("Content-Encoding") != "gzip" {
+				t.Fatalf("missing Content-Encoding: %v", resp.Headers)
+			}
+			framing := "content-length"
+			if resp.Headers.HasToken("transfer-encoding", "chunked") {
+				framing = "chunked"
+			} else if resp.Headers.Get("Content-Length") != fmt.Sprint(len(resp.Body)) {
+				t.Fatalf("Content-Length %q doesn't match the compressed body of %d bytes", resp.Headers.Get("Content-Length"), len(resp.Body))
+			}
+			if framing != tt.wantFraming {
+				t.Fatalf("unexpected framing: %s", framing)
+			}
+			if got := gunzip(t, resp.Body); got != tt.body {
+				t.Fatalf("unexpected body after decompression: %q", got)
+			}
+			if w.BytesWritten() != int64(len(resp.Body)) {
+				t.Fatalf("BytesWritten %d, want %d", w.BytesWritten(), len(resp.Body))
+			}
+		})
+	}
+
+	t.Run("wraps explicit chunked writes", func(t *testing.T) {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		gzipBody(t, w)
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			t.Fatalf("WriteStatusLine error: %v", err)
+		}
+		if err := w.WriteHeaders(Headers{{Name: "Transfer-Encoding", Value: "chunked"}}); err != nil {
+			t.Fatalf("WriteHeaders error: %v", err)
+		}
+		for _, chunk := range []string{"one ", "two ", "three"} {
+			if _, err := w.WriteChunkedBody([]byte(chunk)); err != nil {
+				t.Fatalf("WriteChunkedBody error: %v", err)
+			}
+		}
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			t.Fatalf("WriteChunkedBodyDone error: %v", err)
+		}
+
+		resp, err := ResponseFromReader(&buf, "GET")
+		if err != nil {
+			t.Fatalf("parsing response: %v", err)
+		}
+		if resp.Headers.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("hook didn't run for WriteHeaders: %v", resp.Headers)
+		}
+		if got := gunzip(t, resp.Body); got != "one two three" {
+			t.Fatalf("unexpected body after decompression: %q", got)
+		}
+	})
+
+	t.Run("wrappers see the handler's bytes in reverse order", func(t *testing.T) {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		for _, tag := range []string{"outer", "inner"} {
+			if err := w.WrapBody(func(next io.Writer) io.WriteCloser {
+				return &tagWriter{next: next, tag: tag}
+			}); err != nil {
+				t.Fatalf("WrapBody returned error: %v", err)
+			}
+		}
+		_, _ = io.WriteString(w, "body")
+		if err := w.Finish(); err != nil {
+			t.Fatalf("Finish returned error: %v", err)
+		}
+		resp, err := ResponseFromReader(&buf, "GET")
+		if err != nil {
+			t.Fatalf("parsing response: %v", err)
+		}
+		if string(resp.Body) != "outer(inner(body))" {
+			t.Fatalf("unexpected body: %q", resp.Body)
+		}
+	})
+
+	t.Run("output after a 304 is dropped", func(t *testing.T) {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.SetRequestMethod("GET")
+		w.SetRequestHeaders(Headers{{Name: "If-None-Match", Value: `"v1"`}})
+		if err := w.SetETag("v1", false); err != nil {
+			t.Fatalf("SetETag returned error: %v", err)
+		}
+		gzipBody(t, w)
+		if w.CheckPreconditions() {
+			t.Fatalf("expected the precondition to fail")
+		}
+		if err := w.Finish(); err != nil {
+			t.Fatalf("Finish returned error: %v", err)
+		}
+		resp, err := ResponseFromReader(&buf, "GET")
+		if err != nil {
+			t.Fatalf("parsing response: %v", err)
+		}
+		if resp.StatusLine.StatusCode != StatusNotModified || resp.Headers.Has("Content-Encoding") || len(resp.Body) != 0 {
+			t.Fatalf("unexpected response: %d %v %q", resp.StatusLine.StatusCode, resp.Headers, resp.Body)
+		}
+	})
+
+	t.Run("must come before the body", func(t *testing.T) {
+		w := NewWriter(io.Discard)
+		_, _ = io.WriteString(w, "early")
+		err := w.WrapBody(func(next io.Writer) io.WriteCloser {
+			return &tagWriter{next: next}
+		})
+		if err == nil {
+			t.Fatalf("expected WrapBody to fail after the body started")
+		}
+	})
+}
+
+// tagWriter writes its tag and the bytes it was given in parentheses when it
+// is closed.
+type tagWriter struct {
+	next io.Writer
+	tag  string
+	buf  []byte
+}
+
+func (w *tagWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *tagWriter) Close() error {
+	_, err := fmt.Fprintf(w.next, "%s(%s)", w.tag, w.buf)
+	return err
+}
+
+func TestWriterObservation(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if w.Status() != 0 || w.SentHeaders() != nil || w.Committed() {
+		t.Fatalf("unexpected state before writing: %d %v", w.Status(), w.SentHeaders())
+	}
+	var hookStatus StatusCode
+	w.OnHeaders(func(statusCode StatusCode, h *Headers) {
+		hookStatus = statusCode
+		h.Set("X-Hooked", "1")
+	})
+	var finished []int64
+	w.OnFinish(func(err error) {
+		if err != nil {
+			t.Fatalf("OnFinish got error: %v", err)
+		}
+		finished = append(finished, w.BytesWritten())
+	})
+	w.SetStatus(StatusCreated)
+	_, _ = io.WriteString(w, "created")
+	if len(finished) != 0 {
+		t.Fatalf("OnFinish ran before Finish")
+	}
+	for range 2 {
+		if err := w.Finish(); err != nil {
+			t.Fatalf("Finish returned error: %v", err)
+		}
+	}
+	if len(finished) != 1 || finished[0] != 7 {
+		t.Fatalf("unexpected OnFinish calls: %v", finished)
+	}
+
+	if w.Status() != StatusCreated || hookStatus != StatusCreated || !w.Committed() {
+		t.Fatalf("unexpected status: %d, hook saw %d", w.Status(), hookStatus)
+	}
+	if w.SentHeaders().Get("X-Hooked") != "1" || w.SentHeaders().Get("Content-Length") != "7" {
+		t.Fatalf("unexpected sent headers: %v", w.SentHeaders())
+	}
+	if w.Header().Has("X-Hooked") {
+		t.Fatalf("hook changed the handler's headers: %v", *w.Header())
+	}
+	if w.BytesWritten() != 7 {
+		t.Fatalf("unexpected BytesWritten: %d", w.BytesWritten())
+	}
+	if !strings.Contains(buf.String(), "X-Hooked: 1\r\n") {
+		t.Fatalf("hooked field not sent: %q", buf.String())
+	}
+}
@@ -0,0 +1,122 @@
+package response
+
+import (
+	"fmt"
+	"io"
+)
+
+// Status returns the status code of the response: the one already sent, or
+// else the one set with SetStatus, or 0 if there is neither yet.
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// Committed reports whether the final status line has been written, after
+// which interim responses can no longer be sent.
+func (w *Writer) Committed() bool {
+	return w.state != writerStateStatusLine
+}
+
+// SentHeaders returns the header fields as they went out, after any OnHeaders
+// hooks and connection management, or nil before the header section is
+// written.
+func (w *Writer) SentHeaders() Headers {
+	return w.sent
+}
+
+// OnHeaders registers fn to run just before the header section is written,
+// whether the handler calls WriteHeaders or leaves it to Write, Flush or
+// Finish. fn sees the final status code and may change the fields. Hooks run
+// once, in the order they were registered.
+func (w *Writer) OnHeaders(fn func(statusCode StatusCode, h *Headers)) {
+	w.headerHooks = append(w.headerHooks, fn)
+}
+
+// OnFinish registers fn to run once the response is complete, when Finish
+// returns, with Finish's error. Status, SentHeaders and BytesWritten are final
+// by then, so middleware can log or record the response from fn instead of
+// calling Finish itself. Hooks run once, in the order they were registered.
+func (w *Writer) OnFinish(fn func(err error)) {
+	w.finishHooks = append(w.finishHooks, fn)
+}
+
+// WrapBody replaces the body stream. Body bytes written through Write,
+// WriteBody or WriteChunkedBody go to the writer wrap returns, which is given
+// the stream to write the replaced body to. Flush flushes wrappers that have a
+// Flush method, and the end of the body closes them so they can write what
+// they hold back. Wrappers registered later see the handler's bytes first.
+// It must be called before any of the body is written. A wrapper that changes
+// the body's length should drop Content-Length in an OnHeaders hook, so the
+// framing follows the replaced body; handlers that write their own headers
+// then need chunked encoding.
+func (w *Writer) WrapBody(wrap func(io.Writer) io.WriteCloser) error {
+	if w.state == writerStateDone || len(w.buf) > 0 || w.written > 0 {
+		return fmt.Errorf("body must be wrapped before it is written")
+	}
+	next := w.body
+	if next == nil {
+		next = unwrappedBody{w}
+	}
+	wrapper := wrap(next)
+	w.wrappers = append(w.wrappers, wrapper)
+	w.body = wrapper
+	w.wrapped = true
+	return nil
+}
+
+// runHeaderHooks returns a copy of h changed by the OnHeaders hooks, the
+// first time it is called.
+func (w *Writer) runHeaderHooks(h Headers) Headers {
+	h = h.Clone()
+	if w.hooksDone {
+		return h
+	}
+	w.hooksDone = true
+	for _, fn := range w.headerHooks {
+		fn(w.status, &h)
+	}
+	return h
+}
+
+func (w *Writer) runFinishHooks(err error) {
+	hooks := w.finishHooks
+	w.finishHooks = nil
+	for _, fn := range hooks {
+		fn(err)
+	}
+}
+
+func (w *Writer) flushWrappers() error {
+	for i := len(w.wrappers) - 1; i >= 0; i-- {
+		if f, ok := w.wrappers[i].(interface{ Flush() error }); ok {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// closeWrappers closes the wrappers from the outermost in, so each one's
+// final output reaches the next, and stops routing the body through them.
+func (w *Writer) closeWrappers() error {
+	wrappers := w.wrappers
+	w.wrappers, w.body = nil, nil
+	for i := len(wrappers) - 1; i >= 0; i-- {
+		if err := wrappers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unwrappedBody is the stream the innermost wrapper writes to. Output for a
+// response that can't have a body, such as what a compressor writes on close
+// after a 304, is dropped like any other body bytes.
+type unwrappedBody struct {
+	w *Writer
+}
+
+func (b unwrappedBody) Write(p []byte) (int, error) {
+	return b.w.writeUnwrapped(p)
+}
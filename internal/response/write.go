@@ -0,0 +1,74 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/glebson1988/httpfromtcp/internal/message"
+)
+
+// Write serializes the response as HTTP/1.1 bytes, the counterpart of
+// Request.Write. An empty reason phrase is replaced by StatusText. The body
+// comes from Body if it is set and streams from BodyReader otherwise.
+// Framing headers already present are honoured; without them a body of known
+// size gets a Content-Length, even an empty one, and a streamed body or one
+// with trailers is sent chunked. Responses that can't carry a body, including
+// one parsed as the answer to HEAD, are written without one.
+func (r *Response) Write(w io.Writer) error {
+	statusCode := r.StatusLine.StatusCode
+	reason := r.StatusLine.ReasonPhrase
+	if reason == "" {
+		reason = StatusText(statusCode)
+	}
+	if err := validateStatusCode(statusCode); err != nil {
+		return err
+	}
+	if !validReasonPhrase(reason) {
+		return fmt.Errorf("invalid reason phrase: %q", reason)
+	}
+	version := r.StatusLine.HttpVersion
+	if version == "" {
+		version = "1.1"
+	}
+
+	h := r.Headers.Clone()
+	body, size := r.bodySource()
+	if r.hasBody() && !h.Has("transfer-encoding") && !h.Has("content-length") {
+		if size < 0 || len(r.Trailers) > 0 {
+			h.Set("Transfer-Encoding", "chunked")
+		} else {
+			h.Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+	}
+	if r.hasBody() {
+		if _, _, err := message.BodyFraming(h); err != nil {
+			return err
+		}
+	}
+
+	line := fmt.Sprintf("HTTP/%s %d %s\r\n", version, statusCode, reason)
+	if _, err := io.WriteString(w, line); err != nil {
+		return err
+	}
+	if err := h.Write(w); err != nil {
+		return err
+	}
+	if !r.hasBody() {
+		return nil
+	}
+	return message.WriteBody(w, h, body, &r.Trailers)
+}
+
+// bodySource returns the reader to take the body from and its size, or -1 if
+// it is only known once the reader is exhausted.
+func (r *Response) bodySource() (io.Reader, int64) {
+	if r.Body != nil {
+		return bytes.NewReader(r.Body), int64(len(r.Body))
+	}
+	if r.BodyReader == nil {
+		return nil, 0
+	}
+	return r.BodyReader, -1
+}
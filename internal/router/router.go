@@ -0,0 +1,274 @@
+// Package router dispatches requests to handlers by method and path pattern.
+package router
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/glebson1988/httpfromtcp/internal/headers"
+	"github.com/glebson1988/httpfromtcp/internal/request"
+	"github.com/glebson1988/httpfromtcp/internal/response"
+	"github.com/glebson1988/httpfromtcp/internal/server"
+)
+
+var (
+	ErrInvalidPattern = errors.New("invalid route pattern")
+	ErrConflict       = errors.New("conflicting route")
+)
+
+// Router matches requests against patterns made of "/"-separated segments.
+// A segment is either literal, a parameter such as {id} that matches one
+// non-empty segment, or, as the last segment, a wildcard such as {path...}
+// that matches the rest of the path, slashes included. Literal segments take
+// precedence over parameters and parameters over wildcards, whatever the
+// order of registration. Matched values are available from req.PathValue.
+//
+// Paths that match no pattern get 404, and paths that only match for other
+// methods get 405 with an Allow field. OPTIONS is answered with the allowed
+// methods unless a handler is registered for it, and HEAD falls back to the
+// GET handler.
+type Router struct {
+	root    *node
+	methods map[string]bool
+}
+
+// node is a segment of the pattern tree. Lookups walk one node per path
+// segment.
+type node struct {
+	static       map[string]*node
+	param        *node
+	paramName    string
+	wildcard     *node
+	wildcardName string
+	// pattern and handlers are set on nodes where a pattern ends.
+	pattern  string
+	handlers map[string]server.Handler
+}
+
+type pathValue struct {
+	name, value string
+}
+
+func New() *Router {
+	return &Router{root: &node{}, methods: make(map[string]bool)}
+}
+
+// Handle registers handler for method and pattern. It fails if the pattern
+// is malformed, if the method already has a handler for the same pattern, or
+// if a parameter in the same position of another pattern has a different
+// name, since the two would match the same paths.
+func (r *Router) Handle(method, pattern string, handler server.Handler) error {
+	if !headers.ValidFieldName(method) {
+		return fmt.Errorf("%w: invalid method %q", ErrInvalidPattern, method)
+	}
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("%w: %q doesn't start with /", ErrInvalidPattern, pattern)
+	}
+
+	n := r.root
+	segments := strings.Split(pattern[1:], "/")
+	names := make(map[string]bool)
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			if strings.ContainsAny(segment, "{}") {
+				return fmt.Errorf("%w: %q: parameters must span a whole segment", ErrInvalidPattern, pattern)
+			}
+			if n.static == nil {
+				n.static = make(map[string]*node)
+			}
+			child := n.static[segment]
+			if child == nil {
+				child = &node{}
+				n.static[segment] = child
+			}
+			n = child
+			continue
+		}
+
+		name, isWildcard := strings.CutSuffix(segment[1:len(segment)-1], "...")
+		if !validName(name) {
+			return fmt.Errorf("%w: %q: invalid parameter name %q", ErrInvalidPattern, pattern, name)
+		}
+		if names[name] {
+			return fmt.Errorf("%w: %q: parameter %q appears twice", ErrInvalidPattern, pattern, name)
+		}
+		names[name] = true
+
+		if isWildcard {
+			if i != len(segments)-1 {
+				return fmt.Errorf("%w: %q: a wildcard must be the last segment", ErrInvalidPattern, pattern)
+			}
+			if n.wildcard == nil {
+				n.wildcard, n.wildcardName = &node{}, name
+			} else if n.wildcardName != name {
+				return fmt.Errorf("%w: %s %s: wildcard {%s...} is named {%s...} in %s", ErrConflict, method, pattern, name, n.wildcardName, n.wildcard.anyPattern())
+			}
+			n = n.wildcard
+			continue
+		}
+		if n.param == nil {
+			n.param, n.paramName = &node{}, name
+		} else if n.paramName != name {
+			return fmt.Errorf("%w: %s %s: parameter {%s} is named {%s} in %s", ErrConflict, method, pattern, name, n.paramName, n.param.anyPattern())
+		}
+		n = n.param
+	}
+
+	if _, ok := n.handlers[method]; ok {
+		return fmt.Errorf("%w: %s %s is already registered", ErrConflict, method, pattern)
+	}
+	if n.handlers == nil {
+		n.handlers = make(map[string]server.Handler)
+	}
+	n.pattern = pattern
+	n.handlers[method] = handler
+	r.methods[method] = true
+	return nil
+}
+
+// Serve dispatches req to the handler registered for its method and path.
+// It has the signature of a server.Handler.
+func (r *Router) Serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	target := req.RequestLine.Target
+	if target.Form == request.AsteriskForm && method == "OPTIONS" {
+		writeAllow(w, r.methods, response.StatusNoContent, "")
+		return
+	}
+	if !strings.HasPrefix(target.RawPath, "/") {
+		writeText(w, response.StatusNotFound, "not found")
+		return
+	}
+
+	var handler server.Handler
+	var values []pathValue
+	allowed := make(map[string]bool)
+	r.root.lookup(splitPath(target.RawPath), nil, func(n *node, matched []pathValue) bool {
+		h := n.handlers[method]
+		if h == nil && method == "HEAD" {
+			h = n.handlers["GET"]
+		}
+		if h == nil {
+			for m := range n.handlers {
+				allowed[m] = true
+			}
+			return false
+		}
+		handler, values = h, slices.Clone(matched)
+		return true
+	})
+
+	switch {
+	case handler != nil:
+		if len(values) > 0 {
+			req.PathValues = make(map[string]string, len(values))
+			for _, v := range values {
+				req.PathValues[v.name] = v.value
+			}
+		}
+		handler(w, req)
+	case len(allowed) == 0:
+		writeText(w, response.StatusNotFound, "not found")
+	case method == "OPTIONS":
+		writeAllow(w, allowed, response.StatusNoContent, "")
+	default:
+		writeAllow(w, allowed, response.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// lookup calls visit for each node with handlers that matches segments, most
+// specific first, until visit returns true.
+func (n *node) lookup(segments []string, values []pathValue, visit func(*node, []pathValue) bool) bool {
+	if len(segments) == 0 {
+		return n.handlers != nil && visit(n, values)
+	}
+	segment := segments[0]
+	if child := n.static[segment]; child != nil && child.lookup(segments[1:], values, visit) {
+		return true
+	}
+	if n.param != nil && segment != "" {
+		if n.param.lookup(segments[1:], append(values, pathValue{n.paramName, segment}), visit) {
+			return true
+		}
+	}
+	if n.wildcard != nil && n.wildcard.handlers != nil {
+		return visit(n.wildcard, append(values, pathValue{n.wildcardName, strings.Join(segments, "/")}))
+	}
+	return false
+}
+
+// anyPattern returns a pattern registered at or below n, to name the route a
+// new one conflicts with.
+func (n *node) anyPattern() string {
+	if n.handlers != nil {
+		return n.pattern
+	}
+	for _, child := range n.static {
+		if p := child.anyPattern(); p != "" {
+			return p
+		}
+	}
+	for _, child := range []*node{n.param, n.wildcard} {
+		if child != nil {
+			if p := child.anyPattern(); p != "" {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// splitPath splits a raw path into its percent-decoded segments, so an
+// encoded slash stays inside its segment.
+func splitPath(rawPath string) []string {
+	segments := strings.Split(rawPath[1:], "/")
+	for i, segment := range segments {
+		if decoded, err := url.PathUnescape(segment); err == nil {
+			segments[i] = decoded
+		}
+	}
+	return segments
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, ch := range name {
+		if ch != '_' && !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z') && !(i > 0 && ch >= '0' && ch <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeAllow answers with the methods in allowed as the Allow field, adding
+// the HEAD and OPTIONS the router answers itself.
+func writeAllow(w *response.Writer, allowed map[string]bool, statusCode response.StatusCode, message string) {
+	methods := []string{"OPTIONS"}
+	for m := range allowed {
+		if m != "OPTIONS" && m != "HEAD" {
+			methods = append(methods, m)
+		}
+	}
+	if allowed["GET"] || allowed["HEAD"] {
+		methods = append(methods, "HEAD")
+	}
+	slices.Sort(methods)
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeText(w, statusCode, message)
+}
+
+func writeText(w *response.Writer, statusCode response.StatusCode, message string) {
+	if message != "" {
+		w.Header().Set("Content-Type", "text/plain")
+	}
+	w.SetStatus(statusCode)
+	if message != "" {
+		_, _ = io.WriteString(w, message)
+	}
+}
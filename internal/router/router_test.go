@@ -0,0 +1,174 @@
+package router
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/glebson1988/httpfromtcp/internal/request"
+	"github.com/glebson1988/httpfromtcp/internal/response"
+	"github.com/glebson1988/httpfromtcp/internal/server"
+)
+
+// serve runs target through r and returns the parsed response.
+func serve(t *testing.T, r *Router, method, target string) *response.Response {
+	t.Helper()
+
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: test\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("parsing request: %v", err)
+	}
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	w.SetRequestMethod(method)
+	r.Serve(w, req)
+	if err := w.Finish(); err != nil {
+		t.Fatalf("Finish returned error: %v", err)
+	}
+	resp, err := response.ResponseFromReader(&buf, method)
+	if err != nil {
+		t.Fatalf("parsing response: %v", err)
+	}
+	return resp
+}
+
+// echo answers with the route name and the path values it was given.
+func echo(name string, params ...string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		body := name
+		for _, p := range params {
+			body += fmt.Sprintf(" %s=%s", p, req.PathValue(p))
+		}
+		_, _ = io.WriteString(w, body)
+	}
+}
+
+func newTestRouter(t *testing.T) *Router {
+	t.Helper()
+
+	r := New()
+	routes := []struct {
+		method, pattern string
+		handler         server.Handler
+	}{
+		{"GET", "/", echo("root")},
+		{"GET", "/users", echo("list users")},
+		{"POST", "/users", echo("create user")},
+		{"GET", "/users/me", echo("me")},
+		{"GET", "/users/{id}", echo("user", "id")},
+		{"DELETE", "/users/{id}", echo("delete user", "id")},
+		{"GET", "/users/{id}/posts/{post}", echo("post", "id", "post")},
+		{"GET", "/files/{path...}", echo("file", "path")},
+		{"GET", "/files/readme", echo("readme")},
+		{"PUT", "/upload", echo("upload")},
+		{"OPTIONS", "/custom", echo("custom options")},
+	}
+	for _, route := range routes {
+		if err := r.Handle(route.method, route.pattern, route.handler); err != nil {
+			t.Fatalf("Handle(%s, %s) returned error: %v", route.method, route.pattern, err)
+		}
+	}
+	return r
+}
+
+func TestRouterServe(t *testing.T) {
+	r := newTestRouter(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus response.StatusCode
+		wantBody   string
+		wantAllow  string
+	}{
+		{"root", "GET", "/", response.StatusOK, "root", ""},
+		{"static", "GET", "/users", response.StatusOK, "list users", ""},
+		{"method picks the handler", "POST", "/users", response.StatusOK, "create user", ""},
+		{"query is ignored", "GET", "/users?page=2", response.StatusOK, "list users", ""},
+		{"static beats parameter", "GET", "/users/me", response.StatusOK, "me", ""},
+		{"parameter", "GET", "/users/42", response.StatusOK, "user id=42", ""},
+		{"parameter is decoded", "GET", "/users/a%2Fb", response.StatusOK, "user id=a/b", ""},
+		{"two parameters", "GET", "/users/7/posts/9", response.StatusOK, "post id=7 post=9", ""},
+		{"parameter of another method", "DELETE", "/users/42", response.StatusOK, "delete user id=42", ""},
+		{"wildcard", "GET", "/files/a/b/c.txt", response.StatusOK, "file path=a/b/c.txt", ""},
+		{"empty wildcard", "GET", "/files/", response.StatusOK, "file path=", ""},
+		{"static beats wildcard", "GET", "/files/readme", response.StatusOK, "readme", ""},
+		{"HEAD uses GET", "HEAD", "/users", response.StatusOK, "", ""},
+		{"unknown path", "GET", "/nope", response.StatusNotFound, "not found", ""},
+		{"empty parameter", "GET", "/users//posts/1", response.StatusNotFound, "not found", ""},
+		{"wildcard needs its segment", "GET", "/files", response.StatusNotFound, "not found", ""},
+		{"trailing slash is a different path", "GET", "/users/", response.StatusNotFound, "not found", ""},
+		{"wrong method", "PATCH", "/users", response.StatusMethodNotAllowed, "method not allowed", "GET, HEAD, OPTIONS, POST"},
+		{"wrong method on a parameter", "POST", "/users/42", response.StatusMethodNotAllowed, "method not allowed", "DELETE, GET, HEAD, OPTIONS"},
+		{"wrong method without GET", "GET", "/upload", response.StatusMethodNotAllowed, "method not allowed", "OPTIONS, PUT"},
+		{"automatic OPTIONS", "OPTIONS", "/users/42", response.StatusNoContent, "", "DELETE, GET, HEAD, OPTIONS"},
+		{"automatic OPTIONS merges matches", "OPTIONS", "/users/me", response.StatusNoContent, "", "DELETE, GET, HEAD, OPTIONS"},
+		{"registered OPTIONS", "OPTIONS", "/custom", response.StatusOK, "custom options", ""},
+		{"OPTIONS on unknown path", "OPTIONS", "/nope", response.StatusNotFound, "not found", ""},
+		{"OPTIONS *", "OPTIONS", "*", response.StatusNoContent, "", "DELETE, GET, HEAD, OPTIONS, POST, PUT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := serve(t, r, tt.method, tt.target)
+			if resp.StatusLine.StatusCode != tt.wantStatus {
+				t.Fatalf("unexpected status: %d", resp.StatusLine.StatusCode)
+			}
+			if string(resp.Body) != tt.wantBody {
+				t.Fatalf("unexpected body: %q", resp.Body)
+			}
+			if got := resp.Headers.Get("Allow"); got != tt.wantAllow {
+				t.Fatalf("unexpected Allow: %q", got)
+			}
+		})
+	}
+}
+
+func TestRouterHandleErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		pattern string
+		wantErr error
+	}{
+		{"duplicate route", "GET", "/users/{id}", ErrConflict},
+		{"parameter renamed", "GET", "/users/{name}/friends", ErrConflict},
+		{"wildcard renamed", "POST", "/files/{rest...}", ErrConflict},
+		{"no leading slash", "GET", "users", ErrInvalidPattern},
+		{"partial segment", "GET", "/users/id-{id}", ErrInvalidPattern},
+		{"wildcard not last", "GET", "/static/{path...}/x", ErrInvalidPattern},
+		{"repeated name", "GET", "/a/{id}/b/{id}", ErrInvalidPattern},
+		{"invalid name", "GET", "/a/{1d}", ErrInvalidPattern},
+		{"empty name", "GET", "/a/{}", ErrInvalidPattern},
+		{"invalid method", "GE T", "/a", ErrInvalidPattern},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New()
+			if err := r.Handle("GET", "/users/{id}", echo("user")); err != nil {
+				t.Fatalf("Handle returned error: %v", err)
+			}
+			if err := r.Handle("GET", "/files/{path...}", echo("file")); err != nil {
+				t.Fatalf("Handle returned error: %v", err)
+			}
+			err := r.Handle(tt.method, tt.pattern, echo("new"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRouterSamePatternOtherMethod(t *testing.T) {
+	r := New()
+	if err := r.Handle("GET", "/users/{id}", echo("get")); err != nil {
+		t.Fatalf("Handle returned error: %v", err)
+	}
+	if err := r.Handle("PUT", "/users/{id}", echo("put")); err != nil {
+		t.Fatalf("Handle returned error for another method: %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+package server
+
+// Middleware wraps a Handler with behavior that runs before or after it. It
+// can inspect or wrap the response.Writer, and short-circuit by answering
+// without calling the handler it wraps.
+type Middleware func(Handler) Handler
+
+// Chain combines middleware into one. The first runs outermost, so
+// Chain(a, b)(h) handles a request with a, then b, then h.
+func Chain(middleware ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			h = middleware[i](h)
+		}
+		return h
+	}
+}
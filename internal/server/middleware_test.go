@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/glebson1988/httpfromtcp/internal/request"
+	"github.com/glebson1988/httpfromtcp/internal/response"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				calls = append(calls, name+" before")
+				next(w, req)
+				calls = append(calls, name+" after")
+			}
+		}
+	}
+	requireToken := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if req.Headers.Get("Authorization") != "Bearer secret" {
+				w.SetStatus(response.StatusUnauthorized)
+				_, _ = io.WriteString(w, "no token")
+				return
+			}
+			next(w, req)
+		}
+	}
+	var logged []string
+	logRequests := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			w.OnFinish(func(err error) {
+				if err != nil {
+					return
+				}
+				logged = append(logged, fmt.Sprintf("%s %d %d %s", req.Path(), w.Status(), w.BytesWritten(), w.SentHeaders().Get("Content-Type")))
+			})
+			next(w, req)
+		}
+	}
+	handler := func(w *response.Writer, req *request.Request) {
+		calls = append(calls, "handler")
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "hello")
+	}
+
+	chained := Chain(logRequests, trace("a"), requireToken, trace("b"))(handler)
+	serve := func(raw string) *response.Response {
+		t.Helper()
+		req, err := request.RequestFromReader(strings.NewReader(raw))
+		if err != nil {
+			t.Fatalf("parsing request: %v", err)
+		}
+		var buf bytes.Buffer
+		w := response.NewWriter(&buf)
+		chained(w, req)
+		if err := w.Finish(); err != nil {
+			t.Fatalf("Finish returned error: %v", err)
+		}
+		resp, err := response.ResponseFromReader(&buf, "GET")
+		if err != nil {
+			t.Fatalf("parsing response: %v", err)
+		}
+		return resp
+	}
+
+	resp := serve("GET /ok HTTP/1.1\r\nHost: test\r\nAuthorization: Bearer secret\r\n\r\n")
+	if resp.StatusLine.StatusCode != response.StatusOK || string(resp.Body) != "hello" {
+		t.Fatalf("unexpected response: %d %q", resp.StatusLine.StatusCode, resp.Body)
+	}
+	want := "a before,b before,handler,b after,a after"
+	if got := strings.Join(calls, ","); got != want {
+		t.Fatalf("unexpected call order: %s", got)
+	}
+
+	calls = nil
+	resp = serve("GET /denied HTTP/1.1\r\nHost: test\r\n\r\n")
+	if resp.StatusLine.StatusCode != response.StatusUnauthorized || string(resp.Body) != "no token" {
+		t.Fatalf("unexpected response: %d %q", resp.StatusLine.StatusCode, resp.Body)
+	}
+	if got := strings.Join(calls, ","); got != "a before,a after" {
+		t.Fatalf("middleware didn't short-circuit: %s", got)
+	}
+
+	if got := strings.Join(logged, "|"); got != "/ok 200 5 text/plain|/denied 401 8 " {
+		t.Fatalf("unexpected log: %q", got)
+	}
+}
+
+func TestMiddlewareReplacesBody(t *testing.T) {
+	gzipResponses := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if !req.Headers.HasToken("Accept-Encoding", "gzip") {
+				next(w, req)
+				return
+			}
+			if err := w.WrapBody(func(body io.Writer) io.WriteCloser {
+				return gzip.NewWriter(body)
+			}); err != nil {
+				next(w, req)
+				return
+			}
+			w.OnHeaders(func(statusCode response.StatusCode, h *response.Headers) {
+				h.Del("Content-Length")
+				h.Set("Content-Encoding", "gzip")
+				h.Add("Vary", "Accept-Encoding")
+			})
+			next(w, req)
+		}
+	}
+	srv, err := Serve(0, Chain(gzipResponses)(func(w *response.Writer, req *request.Request) {
+		_, _ = io.WriteString(w, strings.Repeat("compress me ", 100))
+	}))
+	if err != nil {
+		t.Fatalf("Serve returned error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	conn := dial(t, srv.Addr().String())
+	writeString(t, conn, "GET / HTTP/1.1\r\nHost: test\r\nAccept-Encoding: gzip\r\nConnection: close\r\n\r\n")
+	resp, err := response.ResponseFromReader(conn, "GET")
+	if err != nil {
+		t.Fatalf("parsing response: %v", err)
+	}
+	if resp.Headers.Get("Content-Encoding") != "gzip" || len(resp.Body) >= 1200 {
+		t.Fatalf("body wasn't compressed: %v, %d bytes", resp.Headers, len(resp.Body))
+	}
+	zr, err := gzip.NewReader(strings.NewReader(string(resp.Body)))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil || string(plain) != strings.Repeat("compress me ", 100) {
+		t.Fatalf("unexpected body: %q, %v", plain, err)
+	}
+}
+
+func TestMiddlewareObservesServerAnswer(t *testing.T) {
+	statuses := make(chan response.StatusCode, 1)
+	record := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			w.OnFinish(func(err error) {
+				statuses <- w.Status()
+			})
+			next(w, req)
+		}
+	}
+	srv, err := ServeConfig(Config{Addr: "127.0.0.1:0", MaxBodyBytes: 8}, Chain(record)(func(w *response.Writer, req *request.Request) {
+		if body, err := req.ReadBody(); err == nil {
+			_, _ = w.Write(body)
+		}
+	}))
+	if err != nil {
+		t.Fatalf("ServeConfig returned error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	conn := dial(t, srv.Addr().String())
+	writeString(t, conn, "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n12345\r\n5\r\n67890\r\n0\r\n\r\n")
+	resp, err := response.ResponseFromReader(conn, "POST")
+	if err != nil {
+		t.Fatalf("parsing response: %v", err)
+	}
+	if resp.StatusLine.StatusCode != response.StatusContentTooLarge {
+		t.Fatalf("unexpected status: %d", resp.StatusLine.StatusCode)
+	}
+	if got := <-statuses; got != response.StatusContentTooLarge {
+		t.Fatalf("middleware saw status %d", got)
+	}
+}
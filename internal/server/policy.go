@@ -0,0 +1,28 @@
+package server
+
+import (
+	"io"
+
+	"github.com/glebson1988/httpfromtcp/internal/request"
+	"github.com/glebson1988/httpfromtcp/internal/response"
+)
+
+// AllowSubjects wraps next so that only clients with a verified certificate
+// whose subject is in subjects reach it; the rest get 403. An entry matches
+// either the subject's common name or its whole distinguished name, as in
+// request.PeerIdentity.
+func AllowSubjects(subjects []string, next Handler) Handler {
+	allowed := make(map[string]bool, len(subjects))
+	for _, subject := range subjects {
+		allowed[subject] = true
+	}
+	return func(w *response.Writer, req *request.Request) {
+		if req.Peer == nil || !(allowed[req.Peer.CommonName] || allowed[req.Peer.Subject]) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.SetStatus(response.StatusForbidden)
+			_, _ = io.WriteString(w, "client certificate not allowed")
+			return
+		}
+		next(w, req)
+	}
+}
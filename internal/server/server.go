@@ -1,10 +1,17 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/glebson1988/httpfromtcp/internal/request"
 	"github.com/glebson1988/httpfromtcp/internal/response"
@@ -12,26 +19,143 @@ import (
 
 type Handler func(w *response.Writer, req *request.Request)
 
+const (
+	defaultReadHeaderTimeout  = 10 * time.Second
+	defaultIdleTimeout        = 30 * time.Second
+	defaultMaxRequestsPerConn = 100
+	maxDrainBodyBytes         = 256 << 10
+	lingerTimeout             = 500 * time.Millisecond
+	maxLingerBytes            = 256 << 10
+	shutdownPollInterval      = 10 * time.Millisecond
+)
+
+// Config configures a Server. Zero fields take the defaults described on each
+// of them.
+type Config struct {
+	// Addr is the TCP address to listen on, such as "127.0.0.1:8080". An
+	// empty host listens on every interface and port 0 picks a free port.
+	Addr string
+	// ReadHeaderTimeout bounds reading a request's line and headers,
+	// counted from the connection's accept for the first request and from
+	// the first byte for later ones. It defaults to 10 seconds.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds reading a whole request, body included. Zero
+	// leaves the body unbounded.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds the time from the end of the request's headers
+	// to the end of its response. Zero leaves it unbounded.
+	WriteTimeout time.Duration
+	// IdleTimeout bounds the wait for the next request on a keep-alive
+	// connection. It defaults to 30 seconds.
+	IdleTimeout time.Duration
+	// MaxHeaderBytes caps the size of a request's header section. It
+	// defaults to request.DefaultLimits.MaxHeaderBytes.
+	MaxHeaderBytes int
+	// MaxBodyBytes caps the size of a request body. A body declared larger
+	// is refused before the handler runs; a chunked body that grows past it
+	// fails the handler's read, and the server answers 413 unless the
+	// handler already sent a response. Zero leaves bodies unbounded.
+	MaxBodyBytes int64
+	// MaxRequestsPerConn caps the requests served on one keep-alive
+	// connection; the last response carries "Connection: close". It
+	// defaults to 100.
+	MaxRequestsPerConn int
+	// ErrorLog receives errors accepting connections and writing
+	// responses. It defaults to the log package's standard logger.
+	ErrorLog *log.Logger
+}
+
 type Server struct {
-	listener net.Listener
-	closed   atomic.Bool
-	handler  Handler
+	listener           net.Listener
+	closed             atomic.Bool
+	handler            Handler
+	limits             request.Limits
+	readHeaderTimeout  time.Duration
+	readTimeout        time.Duration
+	writeTimeout       time.Duration
+	idleTimeout        time.Duration
+	maxRequestsPerConn int
+	errorLog           *log.Logger
+	certs              *certStore
+	stopReload         func()
+
+	mu           sync.Mutex
+	shuttingDown bool
+	conns        map[net.Conn]connState
 }
 
+// connState tracks where a connection is in its lifecycle so Shutdown knows
+// which ones it may close without cutting off a response.
+type connState int
+
+const (
+	// stateIdle connections wait for the first byte of their next request.
+	stateIdle connState = iota
+	// stateActive connections are reading a request or writing its response.
+	stateActive
+	// stateClosing connections have sent their last response and are
+	// lingering before the close.
+	stateClosing
+)
+
+// Serve listens on port on every interface with the default configuration.
 func Serve(port int, handler Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	return ServeConfig(Config{Addr: fmt.Sprintf(":%d", port)}, handler)
+}
+
+// ServeConfig listens on cfg.Addr and serves connections with handler in the
+// background until the server is closed.
+func ServeConfig(cfg Config, handler Handler) (*Server, error) {
+	listener, err := net.Listen("tcp", cfg.Addr)
 	if err != nil {
 		return nil, err
 	}
+	srv := newServer(cfg, listener, handler)
+	go srv.listen()
+	return srv, nil
+}
 
+func newServer(cfg Config, listener net.Listener, handler Handler) *Server {
 	srv := &Server{
-		listener: listener,
-		handler:  handler,
+		listener:           listener,
+		handler:            handler,
+		limits:             request.DefaultLimits,
+		readHeaderTimeout:  cfg.ReadHeaderTimeout,
+		readTimeout:        cfg.ReadTimeout,
+		writeTimeout:       cfg.WriteTimeout,
+		idleTimeout:        cfg.IdleTimeout,
+		maxRequestsPerConn: defaultMaxRequestsPerConn,
+		errorLog:           cfg.ErrorLog,
+		conns:              make(map[net.Conn]connState),
 	}
-	go srv.listen()
-	return srv, nil
+	if srv.readHeaderTimeout == 0 {
+		srv.readHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if srv.idleTimeout == 0 {
+		srv.idleTimeout = defaultIdleTimeout
+	}
+	if cfg.MaxHeaderBytes > 0 {
+		srv.limits.MaxHeaderBytes = cfg.MaxHeaderBytes
+	}
+	if cfg.MaxBodyBytes > 0 {
+		srv.limits.MaxBodyBytes = cfg.MaxBodyBytes
+	}
+	if cfg.MaxRequestsPerConn > 0 {
+		srv.maxRequestsPerConn = cfg.MaxRequestsPerConn
+	}
+	if srv.errorLog == nil {
+		srv.errorLog = log.Default()
+	}
+	return srv
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
 }
 
+// Close stops accepting connections. Connections already open are left to
+// finish on their own; use Shutdown to wait for them.
 func (s *Server) Close() error {
 	if s == nil {
 		return nil
@@ -39,12 +163,99 @@ func (s *Server) Close() error {
 	if s.closed.Swap(true) {
 		return nil
 	}
+	if s.stopReload != nil {
+		s.stopReload()
+	}
 	if s.listener == nil {
 		return nil
 	}
 	return s.listener.Close()
 }
 
+// Shutdown stops accepting connections, closes idle keep-alive connections
+// and waits for active ones to finish their current response, after which
+// they are closed too. If ctx ends first, the remaining connections are
+// closed forcibly; Shutdown then returns how many of them were in the middle
+// of a request, along with ctx's error.
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	s.shuttingDown = true
+	s.mu.Unlock()
+	if err := s.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return 0, err
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			return s.closeAllConns(), ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleConns closes every idle connection and reports whether none are
+// left open.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state == stateIdle {
+			_ = conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+// closeAllConns closes every open connection and returns how many of them
+// were active.
+func (s *Server) closeAllConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	interrupted := 0
+	for conn, state := range s.conns {
+		if state == stateActive {
+			interrupted++
+		}
+		_ = conn.Close()
+		delete(s.conns, conn)
+	}
+	return interrupted
+}
+
+// setConnState records the state of conn. It refuses to mark a connection
+// idle once shutdown has started, so the caller closes it instead of waiting
+// for another request.
+func (s *Server) setConnState(conn net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state == stateIdle && s.shuttingDown {
+		return false
+	}
+	if _, ok := s.conns[conn]; ok || state == stateIdle {
+		s.conns[conn] = state
+	}
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
 func (s *Server) listen() {
 	for {
 		conn, err := s.listener.Accept()
@@ -52,7 +263,11 @@ func (s *Server) listen() {
 			if s.closed.Load() {
 				return
 			}
-			log.Println("Error accepting connection:", err)
+			s.errorLog.Println("Error accepting connection:", err)
+			continue
+		}
+		if !s.setConnState(conn, stateIdle) {
+			_ = conn.Close()
 			continue
 		}
 		go s.handle(conn)
@@ -60,28 +275,279 @@ func (s *Server) listen() {
 }
 
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	defer func() {
+		s.setConnState(conn, stateClosing)
+		closeConn(conn)
+		s.untrackConn(conn)
+	}()
+
+	var tlsState *tls.ConnectionState
+	var peer *request.PeerIdentity
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state, err := s.handshake(tlsConn)
+		if err != nil {
+			return
+		}
+		tlsState = &state
+		if len(state.VerifiedChains) > 0 {
+			peer = request.NewPeerIdentity(state.PeerCertificates[0])
+		}
+	}
+
+	activity := &activityReader{Conn: conn, server: s}
+	reader := request.NewReader(activity)
+	reader.Limits = s.limits
+	for served := 1; ; served++ {
+		// The first request gets the header timeout from the accept. Later
+		// ones may idle first, and get it from their first byte.
+		deadline := time.Now().Add(s.readHeaderTimeout)
+		activity.started = time.Time{}
+		activity.headerTimeout = 0
+		if served > 1 {
+			if !s.setConnState(conn, stateIdle) {
+				return
+			}
+			deadline = time.Now().Add(s.idleTimeout)
+			activity.headerTimeout = s.readHeaderTimeout
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			s.errorLog.Println("Error setting read deadline:", err)
+			return
+		}
+		req, err := reader.ReadRequest()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isTimeout(err) {
+				return
+			}
+			if err := s.setWriteDeadline(conn); err != nil {
+				return
+			}
+			status := parseErrorStatus(err)
+			s.writeError(response.NewWriter(conn), status, response.StatusText(status))
+			return
+		}
+		s.setConnState(conn, stateActive)
+		req.TLS = tlsState
+		req.Peer = peer
+		// The body is read while the handler runs, under ReadTimeout from
+		// the request's first byte.
+		var bodyDeadline time.Time
+		if s.readTimeout > 0 {
+			started := activity.started
+			if started.IsZero() {
+				started = time.Now()
+			}
+			bodyDeadline = started.Add(s.readTimeout)
+		}
+		if err := conn.SetReadDeadline(bodyDeadline); err != nil {
+			s.errorLog.Println("Error setting read deadline:", err)
+			return
+		}
+		if err := s.setWriteDeadline(conn); err != nil {
+			s.errorLog.Println("Error setting write deadline:", err)
+			return
+		}
 
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
 		writer := response.NewWriter(conn)
-		msg := []byte(err.Error())
-		if err := writer.WriteStatusLine(response.StatusBadRequest); err != nil {
-			log.Println("Error writing status line:", err)
+		writer.SetRequestVersion(req.RequestLine.HttpVersion)
+		writer.SetRequestMethod(req.RequestLine.Method)
+		writer.SetRequestHeaders(req.Headers)
+		if !req.KeepAlive() || served >= s.maxRequestsPerConn || s.isShuttingDown() {
+			writer.CloseAfterResponse()
+		}
+
+		body := &bodyReader{ReadCloser: req.BodyReader}
+		req.BodyReader = body
+		var expect *continueReader
+		if req.RequestLine.HttpVersion != "1.0" && req.Headers.Get("expect") != "" {
+			if !strings.EqualFold(req.Headers.Get("expect"), "100-continue") {
+				s.writeError(writer, response.StatusExpectationFailed, "unsupported expectation")
+				return
+			}
+			expect = &continueReader{ReadCloser: req.BodyReader, writer: writer}
+			req.BodyReader = expect
+		}
+
+		s.handler(writer, req)
+		if errors.Is(body.err, request.ErrBodyTooLarge) && !writer.Committed() {
+			s.writeError(writer, response.StatusContentTooLarge, response.StatusText(response.StatusContentTooLarge))
+		}
+		// Finish runs the OnFinish hooks, after any answer the server gave
+		// in the handler's place.
+		if err := writer.Finish(); err != nil {
+			s.errorLog.Println("Error finishing response:", err)
 			return
 		}
-		headers := response.GetDefaultHeaders(len(msg))
-		if err := writer.WriteHeaders(headers); err != nil {
-			log.Println("Error writing headers:", err)
+		if writer.ShouldClose() {
 			return
 		}
-		if _, err := writer.WriteBody(msg); err != nil {
-			log.Println("Error writing body:", err)
+		// The client may still be waiting to send a body nobody asked for,
+		// so the connection can't be reused.
+		if expect != nil && !expect.sent && req.BodyPending() {
 			return
 		}
+		// Draining what the handler left unread waits on the client, so it
+		// is bounded by the header timeout even when ReadTimeout leaves the
+		// body unbounded.
+		drainDeadline := time.Now().Add(s.readHeaderTimeout)
+		if !bodyDeadline.IsZero() && bodyDeadline.Before(drainDeadline) {
+			drainDeadline = bodyDeadline
+		}
+		if err := conn.SetReadDeadline(drainDeadline); err != nil {
+			s.errorLog.Println("Error setting read deadline:", err)
+			return
+		}
+		if err := req.DiscardBody(maxDrainBodyBytes); err != nil {
+			return
+		}
+	}
+}
+
+// handshake runs the TLS handshake under the header timeout, so a client
+// can't hold the connection open without ever sending a request.
+func (s *Server) handshake(conn *tls.Conn) (tls.ConnectionState, error) {
+	if err := conn.SetDeadline(time.Now().Add(s.readHeaderTimeout)); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	if err := conn.Handshake(); err != nil {
+		if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !isTimeout(err) {
+			s.errorLog.Printf("TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+		}
+		return tls.ConnectionState{}, err
+	}
+	return conn.ConnectionState(), nil
+}
+
+// setWriteDeadline gives the response WriteTimeout from now, or clears the
+// deadline when there is none.
+func (s *Server) setWriteDeadline(conn net.Conn) error {
+	var deadline time.Time
+	if s.writeTimeout > 0 {
+		deadline = time.Now().Add(s.writeTimeout)
+	}
+	return conn.SetWriteDeadline(deadline)
+}
+
+// activityReader notes when the first bytes of a request arrive. It marks the
+// connection active, so Shutdown doesn't close it as idle, and when
+// headerTimeout is set it replaces the idle deadline with the header one.
+type activityReader struct {
+	net.Conn
+	server        *Server
+	started       time.Time
+	headerTimeout time.Duration
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if n > 0 && r.started.IsZero() {
+		r.started = time.Now()
+		r.server.setConnState(r.Conn, stateActive)
+		if r.headerTimeout > 0 {
+			if err := r.Conn.SetReadDeadline(r.started.Add(r.headerTimeout)); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, err
+}
+
+// closeConn shuts down the write side first and discards what the client is
+// still sending, so unread pipelined requests don't make the kernel reset the
+// connection before the client has read our last response.
+func closeConn(conn net.Conn) {
+	defer conn.Close()
+
+	// TLS connections send close_notify first, then linger on the raw
+	// connection underneath.
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.CloseWrite(); err != nil {
+			return
+		}
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.CloseWrite(); err != nil {
+		return
+	}
+	if err := tcpConn.SetReadDeadline(time.Now().Add(lingerTimeout)); err != nil {
+		return
+	}
+	_, _ = io.CopyN(io.Discard, tcpConn, maxLingerBytes)
+}
+
+// bodyReader keeps the first error reading the request body, so the server
+// can answer a body over the size limit when the handler didn't.
+type bodyReader struct {
+	io.ReadCloser
+	err error
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// continueReader sends "100 Continue" the first time the handler reads a body
+// the client is holding back, unless a final response was already written.
+type continueReader struct {
+	io.ReadCloser
+	writer *response.Writer
+	sent   bool
+}
+
+func (r *continueReader) Read(p []byte) (int, error) {
+	if !r.sent && !r.writer.Committed() {
+		if err := r.writer.WriteInterimResponse(response.StatusContinue, nil); err != nil {
+			return 0, err
+		}
+		r.sent = true
+	}
+	return r.ReadCloser.Read(p)
+}
+
+func (s *Server) writeError(writer *response.Writer, statusCode response.StatusCode, message string) {
+	writer.CloseAfterResponse()
+	msg := []byte(message)
+	if err := writer.WriteStatusLine(statusCode); err != nil {
+		s.errorLog.Println("Error writing status line:", err)
 		return
 	}
+	headers := response.GetDefaultHeaders(len(msg))
+	if err := writer.WriteHeaders(headers); err != nil {
+		s.errorLog.Println("Error writing headers:", err)
+		return
+	}
+	if _, err := writer.WriteBody(msg); err != nil {
+		s.errorLog.Println("Error writing body:", err)
+		return
+	}
+}
+
+func parseErrorStatus(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		return response.StatusURITooLong
+	case errors.Is(err, request.ErrHeadersTooLarge), errors.Is(err, request.ErrTooManyHeaders):
+		return response.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return response.StatusContentTooLarge
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return response.StatusNotImplemented
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return response.StatusHTTPVersionNotSupported
+	default:
+		return response.StatusBadRequest
+	}
+}
 
-	writer := response.NewWriter(conn)
-	s.handler(writer, req)
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
@@ -1,11 +1,16 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -123,6 +128,921 @@ func TestServer(t *testing.T) {
 	})
 }
 
+func TestServerKeepAlive(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		body := []byte("path=" + req.RequestLine.RequestTarget)
+		if err := w.WriteStatusLine(response.StatusOK); err != nil {
+			return
+		}
+		if err := w.WriteHeaders(response.GetDefaultHeaders(len(body))); err != nil {
+			return
+		}
+		_, _ = w.WriteBody(body)
+	}
+
+	t.Run("Serves sequential requests on one connection", func(t *testing.T) {
+		srv, err := Serve(0, handler)
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+
+		conn := dial(t, srv.listener.Addr().String())
+		reader := bufio.NewReader(conn)
+		for _, path := range []string{"/one", "/two", "/three"} {
+			writeString(t, conn, fmt.Sprintf("GET %s HTTP/1.1\r\nHost: test\r\n\r\n", path))
+			statusLine, headers, body := readResponse(t, reader)
+			if statusLine != "HTTP/1.1 200 OK" {
+				t.Fatalf("unexpected status line: %q", statusLine)
+			}
+			if _, ok := headers["connection"]; ok {
+				t.Fatalf("unexpected Connection header: %q", headers["connection"])
+			}
+			if body != "path="+path {
+				t.Fatalf("unexpected body: %q", body)
+			}
+		}
+	})
+
+	t.Run("Answers pipelined requests in order", func(t *testing.T) {
+		srv, err := Serve(0, handler)
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+
+		conn := dial(t, srv.listener.Addr().String())
+		writeString(t, conn, "GET /a HTTP/1.1\r\nHost: test\r\n\r\n"+
+			"POST /b HTTP/1.1\r\nHost: test\r\nContent-Length: 3\r\n\r\nabc"+
+			"GET /c HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+
+		reader := bufio.NewReader(conn)
+		for _, path := range []string{"/a", "/b", "/c"} {
+			_, headers, body := readResponse(t, reader)
+			if body != "path="+path {
+				t.Fatalf("unexpected body: %q", body)
+			}
+			if path == "/c" && headers["connection"] != "close" {
+				t.Fatalf("unexpected Connection: %q", headers["connection"])
+			}
+		}
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Fatalf("expected connection to be closed, got %v", err)
+		}
+	})
+
+	t.Run("HTTP/1.0 closes by default", func(t *testing.T) {
+		srv, err := Serve(0, handler)
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+
+		conn := dial(t, srv.listener.Addr().String())
+		writeString(t, conn, "GET /health HTTP/1.0\r\n\r\nGET /health HTTP/1.0\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		statusLine, headers, body := readResponse(t, reader)
+		if statusLine != "HTTP/1.1 200 OK" {
+			t.Fatalf("unexpected status line: %q", statusLine)
+		}
+		if headers["connection"] != "close" {
+			t.Fatalf("unexpected Connection: %q", headers["connection"])
+		}
+		if body != "path=/health" {
+			t.Fatalf("unexpected body: %q", body)
+		}
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Fatalf("expected connection to be closed, got %v", err)
+		}
+	})
+
+	t.Run("HTTP/1.0 keep-alive opt-in", func(t *testing.T) {
+		srv, err := Serve(0, handler)
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+
+		conn := dial(t, srv.listener.Addr().String())
+		reader := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			writeString(t, conn, "GET /health HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+			_, headers, _ := readResponse(t, reader)
+			if headers["connection"] != "keep-alive" {
+				t.Fatalf("unexpected Connection: %q", headers["connection"])
+			}
+		}
+	})
+
+	t.Run("Handler streams the request body", func(t *testing.T) {
+		srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+			body, err := io.ReadAll(req.BodyReader)
+			if err != nil {
+				return
+			}
+			if err := w.WriteStatusLine(response.StatusOK); err != nil {
+				return
+			}
+			if err := w.WriteHeaders(response.GetDefaultHeaders(len(body))); err != nil {
+				return
+			}
+			_, _ = w.WriteBody(body)
+		})
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+
+		conn := dial(t, srv.listener.Addr().String())
+		reader := bufio.NewReader(conn)
+		writeString(t, conn, "POST /echo HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n")
+		writeString(t, conn, "5\r\nhello\r\n")
+		writeString(t, conn, "6\r\n world\r\n0\r\n\r\n")
+		_, _, body := readResponse(t, reader)
+		if body != "hello world" {
+			t.Fatalf("unexpected body: %q", body)
+		}
+	})
+
+	t.Run("Closes after handler sends Connection close", func(t *testing.T) {
+		srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+			headers := response.GetDefaultHeaders(0)
+			headers.Set("Connection", "close")
+			if err := w.WriteStatusLine(response.StatusOK); err != nil {
+				return
+			}
+			if err := w.WriteHeaders(headers); err != nil {
+				return
+			}
+			_, _ = w.WriteBody(nil)
+		})
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+
+		conn := dial(t, srv.listener.Addr().String())
+		writeString(t, conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\nGET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		readResponse(t, reader)
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Fatalf("expected connection to be closed, got %v", err)
+		}
+	})
+
+	t.Run("Closes after a short body", func(t *testing.T) {
+		srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+			if err := w.WriteStatusLine(response.StatusOK); err != nil {
+				return
+			}
+			if err := w.WriteHeaders(response.GetDefaultHeaders(100)); err != nil {
+				return
+			}
+			_, _ = w.WriteBody(make([]byte, 80))
+		})
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+
+		conn := dial(t, srv.listener.Addr().String())
+		writeString(t, conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("ReadAll returned error: %v", err)
+		}
+		parts := strings.SplitN(string(data), "\r\n\r\n", 2)
+		if len(parts) != 2 || len(parts[1]) != 80 {
+			t.Fatalf("unexpected response: %q", string(data))
+		}
+	})
+
+	t.Run("Closes after max requests per connection", func(t *testing.T) {
+		srv, err := Serve(0, handler)
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+
+		conn := dial(t, srv.listener.Addr().String())
+		var reqs strings.Builder
+		for i := 0; i <= defaultMaxRequestsPerConn; i++ {
+			reqs.WriteString("GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		}
+		writeString(t, conn, reqs.String())
+
+		reader := bufio.NewReader(conn)
+		for i := 1; i <= defaultMaxRequestsPerConn; i++ {
+			_, headers, _ := readResponse(t, reader)
+			if i == defaultMaxRequestsPerConn && headers["connection"] != "close" {
+				t.Fatalf("expected Connection: close on request %d", i)
+			}
+		}
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Fatalf("expected connection to be closed, got %v", err)
+		}
+	})
+}
+
+func TestServerParseErrors(t *testing.T) {
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		t.Errorf("handler called for %s", req.RequestLine.RequestTarget)
+	})
+	if err != nil {
+		t.Fatalf("Serve returned error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	var manyHeaders strings.Builder
+	for i := 0; i <= request.DefaultLimits.MaxHeaderCount; i++ {
+		fmt.Fprintf(&manyHeaders, "X-Header-%d: %d\r\n", i, i)
+	}
+
+	tests := []struct {
+		name       string
+		req        string
+		statusLine string
+	}{
+		{
+			name:       "Malformed request line",
+			req:        "GET /\r\n\r\n",
+			statusLine: "HTTP/1.1 400 Bad Request",
+		},
+		{
+			name:       "Unsupported HTTP version",
+			req:        "GET / HTTP/2.0\r\n\r\n",
+			statusLine: "HTTP/1.1 505 HTTP Version Not Supported",
+		},
+		{
+			name:       "Request line too long",
+			req:        "GET /" + strings.Repeat("a", request.DefaultLimits.MaxStartLineBytes) + " HTTP/1.1\r\n\r\n",
+			statusLine: "HTTP/1.1 414 URI Too Long",
+		},
+		{
+			name:       "Too many headers",
+			req:        "GET / HTTP/1.1\r\n" + manyHeaders.String() + "\r\n",
+			statusLine: "HTTP/1.1 431 Request Header Fields Too Large",
+		},
+		{
+			name:       "Header fields too large",
+			req:        "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("b", request.DefaultLimits.MaxHeaderBytes) + "\r\n\r\n",
+			statusLine: "HTTP/1.1 431 Request Header Fields Too Large",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, srv.listener.Addr().String())
+			writeString(t, conn, tt.req)
+			statusLine, headers, body := readResponse(t, bufio.NewReader(conn))
+			if statusLine != tt.statusLine {
+				t.Fatalf("unexpected status line: %q", statusLine)
+			}
+			if headers["connection"] != "close" {
+				t.Fatalf("unexpected Connection: %q", headers["connection"])
+			}
+			// The body names the status and doesn't echo the request.
+			if want := strings.SplitN(statusLine, " ", 3)[2]; body != want {
+				t.Fatalf("unexpected body: %q", body)
+			}
+		})
+	}
+}
+
+func TestServerExpectContinue(t *testing.T) {
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.Headers.Get("x-respond-first") != "" {
+			if err := w.WriteStatusLine(response.StatusOK); err != nil {
+				return
+			}
+			if err := w.WriteHeaders(response.GetDefaultHeaders(5)); err != nil {
+				return
+			}
+			body, err := io.ReadAll(req.BodyReader)
+			if err != nil {
+				return
+			}
+			_, _ = w.WriteBody(body)
+			return
+		}
+		if req.Headers.Get("x-reject") != "" {
+			if err := w.WriteStatusLine(response.StatusContentTooLarge); err != nil {
+				return
+			}
+			if err := w.WriteHeaders(response.GetDefaultHeaders(0)); err != nil {
+				return
+			}
+			_, _ = w.WriteBody(nil)
+			return
+		}
+		body, err := io.ReadAll(req.BodyReader)
+		if err != nil {
+			return
+		}
+		if err := w.WriteStatusLine(response.StatusOK); err != nil {
+			return
+		}
+		if err := w.WriteHeaders(response.GetDefaultHeaders(len(body))); err != nil {
+			return
+		}
+		_, _ = w.WriteBody(body)
+	})
+	if err != nil {
+		t.Fatalf("Serve returned error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	t.Run("Sends 100 Continue when the body is read", func(t *testing.T) {
+		conn := dial(t, srv.listener.Addr().String())
+		reader := bufio.NewReader(conn)
+		writeString(t, conn, "POST /upload HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+
+		interim, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading interim response: %v", err)
+		}
+		if interim != "HTTP/1.1 100 Continue\r\n" {
+			t.Fatalf("unexpected interim status line: %q", interim)
+		}
+		if line, _ := reader.ReadString('\n'); line != "\r\n" {
+			t.Fatalf("unexpected interim header line: %q", line)
+		}
+
+		writeString(t, conn, "hello")
+		statusLine, _, body := readResponse(t, reader)
+		if statusLine != "HTTP/1.1 200 OK" {
+			t.Fatalf("unexpected status line: %q", statusLine)
+		}
+		if body != "hello" {
+			t.Fatalf("unexpected body: %q", body)
+		}
+	})
+
+	t.Run("Skips 100 Continue after the final response", func(t *testing.T) {
+		conn := dial(t, srv.listener.Addr().String())
+		writeString(t, conn, "POST /upload HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\nExpect: 100-continue\r\nX-Respond-First: 1\r\n\r\nhello")
+
+		statusLine, _, body := readResponse(t, bufio.NewReader(conn))
+		if statusLine != "HTTP/1.1 200 OK" {
+			t.Fatalf("unexpected status line: %q", statusLine)
+		}
+		if body != "hello" {
+			t.Fatalf("unexpected body: %q", body)
+		}
+	})
+
+	t.Run("Handler rejects without reading the body", func(t *testing.T) {
+		conn := dial(t, srv.listener.Addr().String())
+		reader := bufio.NewReader(conn)
+		writeString(t, conn, "POST /upload HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\nExpect: 100-continue\r\nX-Reject: 1\r\n\r\n")
+
+		statusLine, _, _ := readResponse(t, reader)
+		if statusLine != "HTTP/1.1 413 Content Too Large" {
+			t.Fatalf("unexpected status line: %q", statusLine)
+		}
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Fatalf("expected connection to be closed, got %v", err)
+		}
+	})
+
+	t.Run("Keeps the connection when there is no body to wait for", func(t *testing.T) {
+		for _, framing := range []string{"", "Content-Length: 0\r\n"} {
+			conn := dial(t, srv.listener.Addr().String())
+			reader := bufio.NewReader(conn)
+			writeString(t, conn, "POST /upload HTTP/1.1\r\nHost: test\r\n"+framing+"Expect: 100-continue\r\nX-Reject: 1\r\n\r\n")
+			statusLine, headers, _ := readResponse(t, reader)
+			if statusLine != "HTTP/1.1 413 Content Too Large" || headers["connection"] == "close" {
+				t.Fatalf("unexpected response: %q, Connection %q", statusLine, headers["connection"])
+			}
+
+			writeString(t, conn, "POST /upload HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\n\r\nhello")
+			statusLine, _, body := readResponse(t, reader)
+			if statusLine != "HTTP/1.1 200 OK" || body != "hello" {
+				t.Fatalf("unexpected second response: %q %q", statusLine, body)
+			}
+		}
+	})
+
+	t.Run("Rejects unknown expectations", func(t *testing.T) {
+		conn := dial(t, srv.listener.Addr().String())
+		writeString(t, conn, "POST /upload HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\nExpect: teapot\r\n\r\n")
+
+		statusLine, headers, _ := readResponse(t, bufio.NewReader(conn))
+		if statusLine != "HTTP/1.1 417 Expectation Failed" {
+			t.Fatalf("unexpected status line: %q", statusLine)
+		}
+		if headers["connection"] != "close" {
+			t.Fatalf("unexpected Connection: %q", headers["connection"])
+		}
+	})
+}
+
+func TestServerAutoFraming(t *testing.T) {
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/empty" {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "hello ")
+		_, _ = io.WriteString(w, "world")
+	})
+	if err != nil {
+		t.Fatalf("Serve returned error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	conn := dial(t, srv.listener.Addr().String())
+	reader := bufio.NewReader(conn)
+
+	writeString(t, conn, "GET /empty HTTP/1.1\r\nHost: test\r\n\r\n")
+	statusLine, headers, body := readResponse(t, reader)
+	if statusLine != "HTTP/1.1 200 OK" || headers["content-length"] != "0" || body != "" {
+		t.Fatalf("unexpected default response: %q %v %q", statusLine, headers, body)
+	}
+
+	writeString(t, conn, "GET /hello HTTP/1.1\r\nHost: test\r\n\r\n")
+	statusLine, headers, body = readResponse(t, reader)
+	if statusLine != "HTTP/1.1 200 OK" || headers["content-type"] != "text/plain" || body != "hello world" {
+		t.Fatalf("unexpected response: %q %v %q", statusLine, headers, body)
+	}
+}
+
+func TestServerHead(t *testing.T) {
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		w.Header().Set("X-Head", fmt.Sprint(w.IsHead()))
+		_, _ = io.WriteString(w, "full body")
+	})
+	if err != nil {
+		t.Fatalf("Serve returned error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	conn := dial(t, srv.listener.Addr().String())
+	writeString(t, conn, "HEAD / HTTP/1.1\r\nHost: test\r\n\r\nGET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	reader := bufio.NewReader(conn)
+
+	var head []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading HEAD response: %v", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		head = append(head, strings.TrimSuffix(line, "\r\n"))
+	}
+	want := []string{"HTTP/1.1 200 OK", "X-Head: true", "Content-Length: 9"}
+	if strings.Join(head, "|") != strings.Join(want, "|") {
+		t.Fatalf("unexpected HEAD response: %q", head)
+	}
+
+	_, headers, body := readResponse(t, reader)
+	if headers["x-head"] != "false" || body != "full body" {
+		t.Fatalf("unexpected GET response: %v %q", headers, body)
+	}
+}
+
+func TestServerConditionalRequests(t *testing.T) {
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		w.ComputeETag()
+		_, _ = io.WriteString(w, "cacheable")
+	})
+	if err != nil {
+		t.Fatalf("Serve returned error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	conn := dial(t, srv.listener.Addr().String())
+	reader := response.NewReader(conn)
+
+	writeString(t, conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	resp, err := reader.ReadResponse("GET")
+	if err != nil {
+		t.Fatalf("ReadResponse returned error: %v", err)
+	}
+	if _, err := resp.ReadBody(); err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	etag := resp.Headers.Get("ETag")
+	if resp.StatusLine.StatusCode != response.StatusOK || etag == "" {
+		t.Fatalf("unexpected response: %d %v", resp.StatusLine.StatusCode, resp.Headers)
+	}
+
+	writeString(t, conn, "GET / HTTP/1.1\r\nHost: test\r\nIf-None-Match: "+etag+"\r\n\r\n")
+	resp, err = reader.ReadResponse("GET")
+	if err != nil {
+		t.Fatalf("ReadResponse returned error: %v", err)
+	}
+	if resp.StatusLine.StatusCode != response.StatusNotModified || resp.Headers.Get("ETag") != etag {
+		t.Fatalf("unexpected conditional response: %d %v", resp.StatusLine.StatusCode, resp.Headers)
+	}
+
+	// The connection is still usable after the bodiless 304.
+	writeString(t, conn, "PUT / HTTP/1.1\r\nHost: test\r\nIf-Match: \"stale\"\r\nContent-Length: 0\r\n\r\n")
+	resp, err = reader.ReadResponse("PUT")
+	if err != nil {
+		t.Fatalf("ReadResponse returned error: %v", err)
+	}
+	if resp.StatusLine.StatusCode != response.StatusPreconditionFailed {
+		t.Fatalf("unexpected status: %d", resp.StatusLine.StatusCode)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	// blockingHandler answers once release is closed, signalling started when
+	// it begins.
+	blockingHandler := func(started chan<- struct{}, release <-chan struct{}) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if req.RequestLine.RequestTarget == "/slow" {
+				started <- struct{}{}
+				<-release
+			}
+			_, _ = io.WriteString(w, "done")
+		}
+	}
+
+	t.Run("Closes idle connections", func(t *testing.T) {
+		srv, err := Serve(0, blockingHandler(nil, nil))
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+		addr := srv.listener.Addr().String()
+
+		conn := dial(t, addr)
+		reader := bufio.NewReader(conn)
+		writeString(t, conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		if statusLine, _, _ := readResponse(t, reader); statusLine != "HTTP/1.1 200 OK" {
+			t.Fatalf("unexpected status line: %q", statusLine)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		interrupted, err := srv.Shutdown(ctx)
+		if err != nil || interrupted != 0 {
+			t.Fatalf("Shutdown returned %d, %v", interrupted, err)
+		}
+		if _, err := reader.ReadByte(); err == nil {
+			t.Fatalf("expected the idle connection to be closed")
+		}
+		if conn, err := net.DialTimeout("tcp", addr, 50*time.Millisecond); err == nil {
+			_ = conn.Close()
+			t.Fatalf("expected dial to fail after Shutdown")
+		}
+	})
+
+	t.Run("Waits for active requests", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		srv, err := Serve(0, blockingHandler(started, release))
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+
+		conn := dial(t, srv.listener.Addr().String())
+		writeString(t, conn, "GET /slow HTTP/1.1\r\nHost: test\r\n\r\n")
+		<-started
+
+		type result struct {
+			interrupted int
+			err         error
+		}
+		done := make(chan result, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			interrupted, err := srv.Shutdown(ctx)
+			done <- result{interrupted, err}
+		}()
+
+		select {
+		case r := <-done:
+			t.Fatalf("Shutdown returned before the handler finished: %d, %v", r.interrupted, r.err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+
+		reader := bufio.NewReader(conn)
+		statusLine, _, body := readResponse(t, reader)
+		if statusLine != "HTTP/1.1 200 OK" || body != "done" {
+			t.Fatalf("unexpected response: %q %q", statusLine, body)
+		}
+		if _, err := reader.ReadByte(); err == nil {
+			t.Fatalf("expected the connection to be closed after the response")
+		}
+		if r := <-done; r.err != nil || r.interrupted != 0 {
+			t.Fatalf("Shutdown returned %d, %v", r.interrupted, r.err)
+		}
+	})
+
+	t.Run("Interrupts requests still running at the deadline", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		defer close(release)
+		srv, err := Serve(0, blockingHandler(started, release))
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+
+		active := dial(t, srv.listener.Addr().String())
+		writeString(t, active, "GET /slow HTTP/1.1\r\nHost: test\r\n\r\n")
+		<-started
+		idle := dial(t, srv.listener.Addr().String())
+		writeString(t, idle, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		readResponse(t, bufio.NewReader(idle))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		interrupted, err := srv.Shutdown(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected DeadlineExceeded, got %v", err)
+		}
+		if interrupted != 1 {
+			t.Fatalf("expected 1 interrupted connection, got %d", interrupted)
+		}
+		if _, err := active.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("expected the active connection to be closed")
+		}
+	})
+}
+
+func TestServerConfig(t *testing.T) {
+	echo := func(w *response.Writer, req *request.Request) {
+		body, err := req.ReadBody()
+		if err != nil {
+			w.SetStatus(response.StatusBadRequest)
+			_, _ = io.WriteString(w, err.Error())
+			return
+		}
+		_, _ = w.Write(body)
+	}
+	serve := func(t *testing.T, cfg Config, handler Handler) *Server {
+		t.Helper()
+		if cfg.Addr == "" {
+			cfg.Addr = "127.0.0.1:0"
+		}
+		srv, err := ServeConfig(cfg, handler)
+		if err != nil {
+			t.Fatalf("ServeConfig returned error: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+		return srv
+	}
+	// expectClosed waits for the server to close conn without a response.
+	expectClosed := func(t *testing.T, conn net.Conn, within time.Duration) {
+		t.Helper()
+		start := time.Now()
+		data, err := io.ReadAll(conn)
+		if err != nil || len(data) != 0 {
+			t.Fatalf("expected a silent close, got %q, %v", data, err)
+		}
+		if elapsed := time.Since(start); elapsed > within {
+			t.Fatalf("connection closed after %v, want within %v", elapsed, within)
+		}
+	}
+
+	t.Run("Listens on the bind address", func(t *testing.T) {
+		srv := serve(t, Config{Addr: "127.0.0.1:0"}, echo)
+		addr, ok := srv.Addr().(*net.TCPAddr)
+		if !ok || !addr.IP.IsLoopback() || addr.Port == 0 {
+			t.Fatalf("unexpected address: %v", srv.Addr())
+		}
+		statusLine, _, _ := sendRequest(t, addr.String(), "/")
+		if statusLine != "HTTP/1.1 200 OK" {
+			t.Fatalf("unexpected status line: %q", statusLine)
+		}
+	})
+
+	t.Run("Read header timeout stops a slow client", func(t *testing.T) {
+		srv := serve(t, Config{ReadHeaderTimeout: 100 * time.Millisecond}, echo)
+		conn := dial(t, srv.Addr().String())
+		// Trickling bytes must not extend the deadline.
+		for _, part := range []string{"GET / HTTP/1.1\r\n", "Host: test\r\n", "X-Slow: 1\r\n"} {
+			writeString(t, conn, part)
+			time.Sleep(40 * time.Millisecond)
+		}
+		expectClosed(t, conn, time.Second)
+	})
+
+	t.Run("Read header timeout starts at the first byte after idling", func(t *testing.T) {
+		srv := serve(t, Config{ReadHeaderTimeout: 100 * time.Millisecond, IdleTimeout: time.Second}, echo)
+		conn := dial(t, srv.Addr().String())
+		reader := bufio.NewReader(conn)
+		writeString(t, conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		readResponse(t, reader)
+
+		time.Sleep(200 * time.Millisecond)
+		writeString(t, conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		if statusLine, _, _ := readResponse(t, reader); statusLine != "HTTP/1.1 200 OK" {
+			t.Fatalf("unexpected status line: %q", statusLine)
+		}
+	})
+
+	t.Run("Idle timeout closes keep-alive connections", func(t *testing.T) {
+		srv := serve(t, Config{IdleTimeout: 100 * time.Millisecond}, echo)
+		conn := dial(t, srv.Addr().String())
+		reader := bufio.NewReader(conn)
+		writeString(t, conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		readResponse(t, reader)
+		if _, err := reader.ReadByte(); err == nil {
+			t.Fatalf("expected the idle connection to be closed")
+		}
+	})
+
+	t.Run("Read timeout bounds the body", func(t *testing.T) {
+		srv := serve(t, Config{ReadTimeout: 100 * time.Millisecond}, echo)
+		conn := dial(t, srv.Addr().String())
+		writeString(t, conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\nabc")
+		statusLine, _, body := readResponse(t, bufio.NewReader(conn))
+		if statusLine != "HTTP/1.1 400 Bad Request" || !strings.Contains(body, "timeout") {
+			t.Fatalf("unexpected response: %q %q", statusLine, body)
+		}
+	})
+
+	t.Run("Header timeout bounds draining an unread body", func(t *testing.T) {
+		srv := serve(t, Config{ReadHeaderTimeout: 100 * time.Millisecond}, func(w *response.Writer, req *request.Request) {
+			_, _ = io.WriteString(w, "ignored the body")
+		})
+		conn := dial(t, srv.Addr().String())
+		writeString(t, conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 100\r\n\r\n0123456789")
+		statusLine, _, _ := readResponse(t, bufio.NewReader(conn))
+		if statusLine != "HTTP/1.1 200 OK" {
+			t.Fatalf("unexpected status line: %q", statusLine)
+		}
+		expectClosed(t, conn, time.Second)
+	})
+
+	t.Run("Write timeout errors go to the error log", func(t *testing.T) {
+		var mu sync.Mutex
+		var logged strings.Builder
+		logger := log.New(writerFunc(func(p []byte) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return logged.Write(p)
+		}), "", 0)
+		srv := serve(t, Config{WriteTimeout: 50 * time.Millisecond, ErrorLog: logger}, func(w *response.Writer, req *request.Request) {
+			time.Sleep(100 * time.Millisecond)
+			_, _ = io.WriteString(w, "late")
+		})
+
+		conn := dial(t, srv.Addr().String())
+		writeString(t, conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		expectClosed(t, conn, time.Second)
+		mu.Lock()
+		defer mu.Unlock()
+		if !strings.Contains(logged.String(), "Error finishing response") {
+			t.Fatalf("expected the write error to be logged, got %q", logged.String())
+		}
+	})
+
+	t.Run("Max header bytes", func(t *testing.T) {
+		srv := serve(t, Config{MaxHeaderBytes: 64}, echo)
+		conn := dial(t, srv.Addr().String())
+		writeString(t, conn, "GET / HTTP/1.1\r\nHost: test\r\nX-Long: "+strings.Repeat("a", 64)+"\r\n\r\n")
+		statusLine, _, _ := readResponse(t, bufio.NewReader(conn))
+		if statusLine != "HTTP/1.1 431 Request Header Fields Too Large" {
+			t.Fatalf("unexpected status line: %q", statusLine)
+		}
+	})
+
+	t.Run("Max body bytes", func(t *testing.T) {
+		srv := serve(t, Config{MaxBodyBytes: 8}, func(w *response.Writer, req *request.Request) {
+			// The handler ignores the read error and leaves the answer to
+			// the server.
+			if body, err := req.ReadBody(); err == nil {
+				_, _ = w.Write(body)
+			}
+		})
+		tests := []struct {
+			name       string
+			req        string
+			statusLine string
+		}{
+			{"within the limit", "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 8\r\n\r\n12345678", "HTTP/1.1 200 OK"},
+			{"declared too large", "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 9\r\n\r\n123456789", "HTTP/1.1 413 Content Too Large"},
+			{"chunked too large", "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n12345\r\n5\r\n67890\r\n0\r\n\r\n", "HTTP/1.1 413 Content Too Large"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conn := dial(t, srv.Addr().String())
+				writeString(t, conn, tt.req)
+				statusLine, _, _ := readResponse(t, bufio.NewReader(conn))
+				if statusLine != tt.statusLine {
+					t.Fatalf("unexpected status line: %q", statusLine)
+				}
+			})
+		}
+	})
+
+	t.Run("Max requests per connection", func(t *testing.T) {
+		srv := serve(t, Config{MaxRequestsPerConn: 2}, echo)
+		conn := dial(t, srv.Addr().String())
+		writeString(t, conn, strings.Repeat("GET / HTTP/1.1\r\nHost: test\r\n\r\n", 3))
+		reader := bufio.NewReader(conn)
+		for i := 1; i <= 2; i++ {
+			_, headers, _ := readResponse(t, reader)
+			if closing := headers["connection"] == "close"; closing != (i == 2) {
+				t.Fatalf("request %d: unexpected Connection header %q", i, headers["connection"])
+			}
+		}
+		if rest, err := io.ReadAll(reader); err != nil || len(rest) != 0 {
+			t.Fatalf("expected the connection to close, got %q, %v", rest, err)
+		}
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("SetDeadline returned error: %v", err)
+	}
+	return conn
+}
+
+func writeString(t *testing.T, conn net.Conn, s string) {
+	t.Helper()
+
+	if _, err := io.WriteString(conn, s); err != nil {
+		t.Fatalf("WriteString returned error: %v", err)
+	}
+}
+
+func readResponse(t *testing.T, reader *bufio.Reader) (string, map[string]string, string) {
+	t.Helper()
+
+	statusLine, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading status line: %v", err)
+	}
+
+	headers := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading header line: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, ": ", 2)
+		if len(kv) != 2 {
+			t.Fatalf("invalid header line: %q", line)
+		}
+		headers[strings.ToLower(kv[0])] = kv[1]
+	}
+
+	length, err := strconv.Atoi(headers["content-length"])
+	if err != nil {
+		t.Fatalf("invalid Content-Length: %q", headers["content-length"])
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+
+	return strings.TrimSuffix(statusLine, "\r\n"), headers, string(body)
+}
+
 func sendRequest(t *testing.T, addr, path string) (string, map[string]string, string) {
 	t.Helper()
 
@@ -132,7 +1052,7 @@ func sendRequest(t *testing.T, addr, path string) (string, map[string]string, st
 	}
 	defer conn.Close()
 
-	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, addr)
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", path, addr)
 	if _, err := io.WriteString(conn, req); err != nil {
 		t.Fatalf("WriteString returned error: %v", err)
 	}
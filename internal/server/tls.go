@@ -0,0 +1,188 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// Certificate names the PEM files of a certificate chain and its private key.
+type Certificate struct {
+	CertFile string
+	KeyFile  string
+}
+
+// TLSConfig configures TLS termination for ServeTLS.
+type TLSConfig struct {
+	// Certificates are served by the SNI name the client asks for. The
+	// first one is the fallback for clients that send no name or one that
+	// no certificate covers.
+	Certificates []Certificate
+	// MinVersion is the lowest TLS version accepted. It defaults to TLS 1.2.
+	MinVersion uint16
+	// ClientAuth is whether the listener asks clients for certificates.
+	ClientAuth ClientAuth
+	// ClientCAFile holds the PEM certificates of the CAs client certificates
+	// must chain to. It is required unless ClientAuth is ClientAuthNone, and
+	// reloaded along with the certificates.
+	ClientCAFile string
+}
+
+// ClientAuth is a listener's policy for client certificates.
+type ClientAuth int
+
+const (
+	// ClientAuthNone doesn't ask for client certificates.
+	ClientAuthNone ClientAuth = iota
+	// ClientAuthRequest asks for a certificate and verifies it when one is
+	// given, but still accepts clients without one.
+	ClientAuthRequest
+	// ClientAuthRequire fails the handshake of clients without a valid
+	// certificate.
+	ClientAuthRequire
+)
+
+// ServeTLS is ServeConfig over TLS. The certificates are loaded up front and
+// reloaded from the same files when the process receives SIGHUP, so they can
+// be rotated without a restart; a failed reload keeps the previous ones.
+func ServeTLS(cfg Config, tlsCfg TLSConfig, handler Handler) (*Server, error) {
+	var clientAuth tls.ClientAuthType
+	switch tlsCfg.ClientAuth {
+	case ClientAuthNone:
+		clientAuth = tls.NoClientCert
+	case ClientAuthRequest:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %d", tlsCfg.ClientAuth)
+	}
+	if clientAuth != tls.NoClientCert && tlsCfg.ClientCAFile == "" {
+		return nil, errors.New("client certificate verification needs a client CA file")
+	}
+
+	store := &certStore{files: tlsCfg.Certificates}
+	if clientAuth != tls.NoClientCert {
+		store.clientCAFile = tlsCfg.ClientCAFile
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	minVersion := tlsCfg.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	base := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: store.certificate,
+		NextProtos:     []string{"http/1.1"},
+		ClientAuth:     clientAuth,
+	}
+	// Each handshake gets the client CAs loaded most recently.
+	config := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := base.Clone()
+			c.ClientCAs = store.clientCAs.Load()
+			return c, nil
+		},
+	}
+
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := newServer(cfg, tls.NewListener(listener, config), handler)
+	srv.certs = store
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	srv.stopReload = func() {
+		signal.Stop(hup)
+		close(done)
+	}
+	go func() {
+		for {
+			select {
+			case <-hup:
+				if err := srv.ReloadCertificates(); err != nil {
+					srv.errorLog.Println("Error reloading certificates:", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	go srv.listen()
+	return srv, nil
+}
+
+// ReloadCertificates loads the certificate, key and client CA files again.
+// New handshakes use the new certificates; if any file fails to load, the
+// previous ones stay in use.
+func (s *Server) ReloadCertificates() error {
+	if s.certs == nil {
+		return errors.New("server is not serving TLS")
+	}
+	return s.certs.load()
+}
+
+// certStore holds the loaded certificates, swapped as a whole on reload so
+// handshakes never see a partial set.
+type certStore struct {
+	files        []Certificate
+	clientCAFile string
+	certs        atomic.Pointer[[]tls.Certificate]
+	clientCAs    atomic.Pointer[x509.CertPool]
+}
+
+func (c *certStore) load() error {
+	if len(c.files) == 0 {
+		return errors.New("no TLS certificates configured")
+	}
+	certs := make([]tls.Certificate, 0, len(c.files))
+	for _, f := range c.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading certificate %s: %w", f.CertFile, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	var pool *x509.CertPool
+	if c.clientCAFile != "" {
+		data, err := os.ReadFile(c.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("loading client CAs: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("loading client CAs: no certificates in %s", c.clientCAFile)
+		}
+	}
+	c.certs.Store(&certs)
+	c.clientCAs.Store(pool)
+	return nil
+}
+
+// certificate picks the first certificate valid for the client's SNI name
+// and capabilities, or the first one when none is.
+func (c *certStore) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := *c.certs.Load()
+	if hello.ServerName != "" {
+		for i := range certs {
+			if certs[i].Leaf != nil && certs[i].Leaf.VerifyHostname(hello.ServerName) == nil &&
+				hello.SupportsCertificate(&certs[i]) == nil {
+				return &certs[i], nil
+			}
+		}
+	}
+	return &certs[0], nil
+}
@@ -0,0 +1,440 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/glebson1988/httpfromtcp/internal/request"
+	"github.com/glebson1988/httpfromtcp/internal/response"
+)
+
+// testCert is a certificate written to PEM files.
+type testCert struct {
+	Certificate
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a self-signed certificate for names.
+func newTestCert(t *testing.T, commonName string, names []string) *testCert {
+	t.Helper()
+	return issueTestCert(t, commonName, names, nil)
+}
+
+// issueTestCert creates a certificate for names signed by ca, or a
+// self-signed one that can sign others when ca is nil.
+func issueTestCert(t *testing.T, commonName string, names []string, ca *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("generating serial: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling key: %v", err)
+	}
+
+	dir := t.TempDir()
+	tc := &testCert{
+		Certificate: Certificate{
+			CertFile: filepath.Join(dir, "cert.pem"),
+			KeyFile:  filepath.Join(dir, "key.pem"),
+		},
+		cert: cert,
+		key:  key,
+	}
+	writePEM(t, tc.CertFile, "CERTIFICATE", der)
+	writePEM(t, tc.KeyFile, "EC PRIVATE KEY", keyDER)
+	return tc
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+}
+
+// dialTLS connects to addr trusting roots and asking for serverName,
+// presenting clientCert when it is set.
+func dialTLS(t *testing.T, addr, serverName string, roots []*testCert, clientCert ...*testCert) (*tls.Conn, error) {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	for _, root := range roots {
+		pool.AddCert(root.cert)
+	}
+	config := &tls.Config{
+		RootCAs:    pool,
+		ServerName: serverName,
+	}
+	// Present the certificate even when it isn't from a CA the server
+	// lists, which the default selection would skip.
+	for _, c := range clientCert {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}, nil
+		}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("SetDeadline returned error: %v", err)
+	}
+	return conn, nil
+}
+
+func serveTLS(t *testing.T, tlsCfg TLSConfig, handler Handler) *Server {
+	t.Helper()
+
+	srv, err := ServeTLS(Config{Addr: "127.0.0.1:0", ErrorLog: log.New(io.Discard, "", 0)}, tlsCfg, handler)
+	if err != nil {
+		t.Fatalf("ServeTLS returned error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+	return srv
+}
+
+// tlsInfoHandler answers with the TLS version, cipher and client subject the
+// handler saw.
+func tlsInfoHandler(w *response.Writer, req *request.Request) {
+	if req.TLS == nil {
+		_, _ = io.WriteString(w, "plaintext")
+		return
+	}
+	info := tls.VersionName(req.TLS.Version) + " " + tls.CipherSuiteName(req.TLS.CipherSuite)
+	if len(req.TLS.PeerCertificates) > 0 {
+		info += " " + req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	_, _ = io.WriteString(w, info)
+}
+
+func TestServeTLS(t *testing.T) {
+	example := newTestCert(t, "example", []string{"example.test"})
+	other := newTestCert(t, "other", []string{"other.test"})
+	roots := []*testCert{example, other}
+
+	t.Run("Serves requests with the connection state", func(t *testing.T) {
+		srv := serveTLS(t, TLSConfig{Certificates: []Certificate{example.Certificate}}, tlsInfoHandler)
+		conn, err := dialTLS(t, srv.Addr().String(), "example.test", roots)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		writeString(t, conn, "GET / HTTP/1.1\r\nHost: example.test\r\n\r\n")
+		statusLine, _, body := readResponse(t, bufio.NewReader(conn))
+		if statusLine != "HTTP/1.1 200 OK" {
+			t.Fatalf("unexpected status line: %q", statusLine)
+		}
+		state := conn.ConnectionState()
+		want := tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite)
+		if body != want {
+			t.Fatalf("unexpected body: %q, want %q", body, want)
+		}
+	})
+
+	t.Run("Selects the certificate by SNI", func(t *testing.T) {
+		srv := serveTLS(t, TLSConfig{Certificates: []Certificate{example.Certificate, other.Certificate}}, tlsInfoHandler)
+		for name, want := range map[string]string{"example.test": "example", "other.test": "other"} {
+			conn, err := dialTLS(t, srv.Addr().String(), name, roots)
+			if err != nil {
+				t.Fatalf("dial %q: %v", name, err)
+			}
+			if got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; got != want {
+				t.Fatalf("name %q got certificate %q, want %q", name, got, want)
+			}
+		}
+
+		// Without SNI the first certificate is the fallback.
+		conn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("dial without SNI: %v", err)
+		}
+		defer conn.Close()
+		if got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; got != "example" {
+			t.Fatalf("unexpected fallback certificate: %q", got)
+		}
+	})
+
+	t.Run("Reloads certificates", func(t *testing.T) {
+		initial := newTestCert(t, "initial", []string{"example.test"})
+		srv := serveTLS(t, TLSConfig{Certificates: []Certificate{initial.Certificate}}, tlsInfoHandler)
+		rotated := newTestCert(t, "rotated", []string{"example.test"})
+		copyFile(t, rotated.CertFile, initial.CertFile)
+		copyFile(t, rotated.KeyFile, initial.KeyFile)
+		if err := srv.ReloadCertificates(); err != nil {
+			t.Fatalf("ReloadCertificates returned error: %v", err)
+		}
+		conn, err := dialTLS(t, srv.Addr().String(), "example.test", []*testCert{rotated})
+		if err != nil {
+			t.Fatalf("dial after reload: %v", err)
+		}
+		if got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; got != "rotated" {
+			t.Fatalf("unexpected certificate after reload: %q", got)
+		}
+
+		// A broken file keeps the previous certificates.
+		if err := os.WriteFile(initial.KeyFile, []byte("garbage"), 0o600); err != nil {
+			t.Fatalf("writing key: %v", err)
+		}
+		if err := srv.ReloadCertificates(); err == nil {
+			t.Fatalf("expected ReloadCertificates to fail")
+		}
+		if _, err := dialTLS(t, srv.Addr().String(), "example.test", []*testCert{rotated}); err != nil {
+			t.Fatalf("dial after failed reload: %v", err)
+		}
+	})
+
+	t.Run("Reloads certificates on SIGHUP", func(t *testing.T) {
+		initial := newTestCert(t, "initial", []string{"example.test"})
+		srv := serveTLS(t, TLSConfig{Certificates: []Certificate{initial.Certificate}}, tlsInfoHandler)
+		rotated := newTestCert(t, "rotated", []string{"example.test"})
+		copyFile(t, rotated.CertFile, initial.CertFile)
+		copyFile(t, rotated.KeyFile, initial.KeyFile)
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatalf("sending SIGHUP: %v", err)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			conn, err := dialTLS(t, srv.Addr().String(), "example.test", []*testCert{initial, rotated})
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			if conn.ConnectionState().PeerCertificates[0].Subject.CommonName == "rotated" {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("certificate was not reloaded on SIGHUP")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("Plaintext requests have no TLS state", func(t *testing.T) {
+		srv, err := Serve(0, tlsInfoHandler)
+		if err != nil {
+			t.Fatalf("Serve returned error: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+		if _, _, body := sendRequest(t, srv.Addr().String(), "/"); body != "plaintext" {
+			t.Fatalf("unexpected body: %q", body)
+		}
+	})
+
+	t.Run("Rejects missing certificate files", func(t *testing.T) {
+		_, err := ServeTLS(Config{Addr: "127.0.0.1:0"}, TLSConfig{Certificates: []Certificate{{
+			CertFile: filepath.Join(t.TempDir(), "missing.pem"),
+			KeyFile:  filepath.Join(t.TempDir(), "missing.key"),
+		}}}, tlsInfoHandler)
+		if err == nil {
+			t.Fatalf("expected ServeTLS to fail")
+		}
+	})
+}
+
+// peerHandler answers with the client's verified common name and
+// fingerprint, or "anonymous".
+func peerHandler(w *response.Writer, req *request.Request) {
+	if req.Peer == nil {
+		_, _ = io.WriteString(w, "anonymous")
+		return
+	}
+	_, _ = io.WriteString(w, req.Peer.CommonName+" "+strings.Join(req.Peer.DNSNames, ",")+" "+req.Peer.Fingerprint)
+}
+
+// tlsRequest sends a GET for path over conn and returns the status line and
+// body, or the error that ended the connection.
+func tlsRequest(t *testing.T, conn *tls.Conn, path string) (string, string, error) {
+	t.Helper()
+
+	if _, err := io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: example.test\r\nConnection: close\r\n\r\n"); err != nil {
+		return "", "", err
+	}
+	resp, err := response.ResponseFromReader(conn, "GET")
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%d", resp.StatusLine.StatusCode), string(resp.Body), nil
+}
+
+func TestServeTLSClientAuth(t *testing.T) {
+	serverCert := newTestCert(t, "example", []string{"example.test"})
+	ca := newTestCert(t, "Test CA", nil)
+	billing := issueTestCert(t, "billing", []string{"billing.internal"}, ca)
+	reports := issueTestCert(t, "reports", nil, ca)
+	untrusted := issueTestCert(t, "billing", nil, newTestCert(t, "Other CA", nil))
+	roots := []*testCert{serverCert}
+
+	serve := func(t *testing.T, mode ClientAuth, handler Handler) string {
+		t.Helper()
+		srv := serveTLS(t, TLSConfig{
+			Certificates: []Certificate{serverCert.Certificate},
+			ClientAuth:   mode,
+			ClientCAFile: ca.CertFile,
+		}, handler)
+		return srv.Addr().String()
+	}
+	// get dials with clientCert, if any, and returns the response or the
+	// error from the handshake or the request.
+	get := func(t *testing.T, addr string, clientCert ...*testCert) (string, string, error) {
+		t.Helper()
+		conn, err := dialTLS(t, addr, "example.test", roots, clientCert...)
+		if err != nil {
+			return "", "", err
+		}
+		return tlsRequest(t, conn, "/")
+	}
+
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256(billing.cert.Raw))
+	tests := []struct {
+		name       string
+		mode       ClientAuth
+		clientCert *testCert
+		wantErr    bool
+		wantBody   string
+	}{
+		{"require with a valid certificate", ClientAuthRequire, billing, false, "billing billing.internal " + fingerprint},
+		{"require without a certificate", ClientAuthRequire, nil, true, ""},
+		{"require with an untrusted certificate", ClientAuthRequire, untrusted, true, ""},
+		{"request with a valid certificate", ClientAuthRequest, billing, false, "billing billing.internal " + fingerprint},
+		{"request without a certificate", ClientAuthRequest, nil, false, "anonymous"},
+		{"request with an untrusted certificate", ClientAuthRequest, untrusted, true, ""},
+		{"none ignores certificates", ClientAuthNone, billing, false, "anonymous"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serve(t, tt.mode, peerHandler)
+			var certs []*testCert
+			if tt.clientCert != nil {
+				certs = append(certs, tt.clientCert)
+			}
+			status, body, err := get(t, addr, certs...)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected the connection to fail, got %s %q", status, body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if status != "200" || body != tt.wantBody {
+				t.Fatalf("unexpected response: %s %q", status, body)
+			}
+		})
+	}
+
+	t.Run("Peer identity", func(t *testing.T) {
+		id := request.NewPeerIdentity(billing.cert)
+		if id.Subject != "CN=billing" || id.CommonName != "billing" || id.Fingerprint != fingerprint {
+			t.Fatalf("unexpected identity: %+v", id)
+		}
+		if len(id.DNSNames) != 1 || id.DNSNames[0] != "billing.internal" {
+			t.Fatalf("unexpected DNS names: %v", id.DNSNames)
+		}
+	})
+
+	t.Run("Allowed subjects", func(t *testing.T) {
+		addr := serve(t, ClientAuthRequest, AllowSubjects([]string{"billing"}, peerHandler))
+		for _, tc := range []struct {
+			name       string
+			clientCert *testCert
+			wantStatus string
+		}{
+			{"allowed", billing, "200"},
+			{"other subject", reports, "403"},
+			{"no certificate", nil, "403"},
+		} {
+			var certs []*testCert
+			if tc.clientCert != nil {
+				certs = append(certs, tc.clientCert)
+			}
+			status, _, err := get(t, addr, certs...)
+			if err != nil {
+				t.Fatalf("%s: request failed: %v", tc.name, err)
+			}
+			if status != tc.wantStatus {
+				t.Fatalf("%s: unexpected status %s", tc.name, status)
+			}
+		}
+	})
+
+	t.Run("Verification needs a CA file", func(t *testing.T) {
+		_, err := ServeTLS(Config{Addr: "127.0.0.1:0"}, TLSConfig{
+			Certificates: []Certificate{serverCert.Certificate},
+			ClientAuth:   ClientAuthRequire,
+		}, peerHandler)
+		if err == nil {
+			t.Fatalf("expected ServeTLS to fail")
+		}
+	})
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("reading %s: %v", src, err)
+	}
+	if err := os.WriteFile(dst, data, 0o600); err != nil {
+		t.Fatalf("writing %s: %v", dst, err)
+	}
+}